@@ -0,0 +1,499 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "mime"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "jesseboth/fdt/src/game"
+    "jesseboth/fdt/src/util"
+)
+
+// Config is what the telemetry pipeline runs with, /control changes it while fdt runs
+type Config struct {
+    Game     string `json:"game"` // abbreviated game id or auto
+    Split    string `json:"split"`
+    Port     int    `json:"port"`
+    Outsim   int    `json:"outsim,omitempty"` // second port for OutSim, 0 when it is sent to Port
+    Host     string `json:"host,omitempty"`   // console or PC running games that must be asked for telemetry
+    Password string `json:"-"`                // ACC broadcasting password, never reported
+    Debug    bool   `json:"debug"`
+    Capture  bool   `json:"capture"` // reading packets
+
+    // Replaying a session instead of listening, set from the command line only
+    Replay      string        `json:"replay,omitempty"`
+    ReplaySpeed float64       `json:"-"`
+    ReplaySeek  time.Duration `json:"-"`
+    ReplayLoop  bool          `json:"-"`
+}
+
+// configChange is a /control request, missing fields keep their value
+type configChange struct {
+    Game     *string `json:"game"`
+    Split    *string `json:"split"`
+    Port     *int    `json:"port"`
+    Outsim   *int    `json:"outsim"`
+    Host     *string `json:"host"`
+    Password *string `json:"password"`
+    Debug    *bool   `json:"debug"`
+    Capture  *bool   `json:"capture"`
+}
+
+// controlReport is the active configuration returned by /control
+type controlReport struct {
+    Config
+    Running bool   `json:"running"`          // the telemetry loop is reading
+    Active  string `json:"active,omitempty"` // game being decoded, the detected one with auto
+    Error   string `json:"error,omitempty"`
+}
+
+// pipeline owns the sockets and the telemetry loop. The split type and debug
+// logging are changed in the running loop, any other change stops the loop,
+// stores the odometer and timing data and starts again with the new
+// configuration, timing state kept in memory survives.
+type pipeline struct {
+    mu       sync.Mutex
+    config   Config
+    recorder *util.Recorder // kept across restarts of the same game and port, nil when not recording
+
+    running bool
+    cancel  context.CancelFunc
+    done    chan error  // result of the running loop
+    remote  io.Closer   // connection to a game that must be told we are leaving
+    inputs  []io.Closer // closed to stop a blocked read
+    source  util.PacketReader
+
+    ended chan error // loops that stopped on their own, a replay that finished or failed
+}
+
+func newPipeline(config Config, recorder *util.Recorder) *pipeline {
+    return &pipeline{config: config, recorder: recorder, ended: make(chan error, 1)}
+}
+
+// Start begins reading with the configuration the pipeline was created with
+func (p *pipeline) Start() error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if !p.config.Capture {
+        return nil
+    }
+    format, err := loadFormat(p.config)
+    if err != nil {
+        return err
+    }
+    return p.start(format)
+}
+
+// ApplyChange makes the requested changes to the running configuration.
+// The configuration is read and replaced under one lock, so concurrent
+// changes do not undo each other.
+func (p *pipeline) ApplyChange(change configChange) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.apply(p.config.with(change))
+}
+
+// apply switches to a new configuration, p.mu is held. Nothing changes when
+// it is invalid, the previous configuration is restored when the new one
+// fails to start.
+func (p *pipeline) apply(next Config) error {
+    if err := validConfig(next); err != nil {
+        return err
+    }
+    if next.sameInputs(p.config) && p.running == next.Capture {
+        p.applyInPlace(next)
+        return nil
+    }
+
+    var format *util.Format
+    if next.Capture {
+        var err error
+        if format, err = loadFormat(next); err != nil {
+            return err
+        }
+    }
+
+    prev := p.config
+    if p.running && !p.stop(shutdownTimeout) {
+        return errors.New("telemetry loop did not stop")
+    }
+    // Sessions do not store the game, datagrams of another game or port
+    // would be replayed with the wrong format
+    if p.recorder != nil && (next.Game != prev.Game || next.Port != prev.Port || next.Outsim != prev.Outsim) {
+        p.closeRecorder()
+        log.Println("Recording stopped, a session holds the datagrams of one game")
+    }
+    p.config = next
+    if !next.Capture {
+        log.Println("Capture stopped")
+        return nil
+    }
+
+    err := p.start(format)
+    if err == nil {
+        return nil
+    }
+    log.Printf("Error starting %s, going back to %s: %v", next.Game, prev.Game, err)
+    p.config = prev
+    if prev.Capture {
+        if format, ferr := loadFormat(prev); ferr == nil {
+            if serr := p.start(format); serr != nil {
+                log.Printf("Error starting %s again: %v", prev.Game, serr)
+            }
+        }
+    }
+    return err
+}
+
+// applyInPlace changes the split type and debug logging without stopping the loop, p.mu is held
+func (p *pipeline) applyInPlace(next Config) {
+    prev := p.config
+    p.config = next
+    if next.Split != prev.Split {
+        game.ForzaSetSplit(next.Split)
+        log.Printf("Split type set to %s", next.Split)
+    }
+    if next.Debug != prev.Debug {
+        game.SetDebug(next.Debug)
+        if next.Debug {
+            log.Println("Debug mode enabled")
+        } else {
+            log.Println("Debug mode disabled")
+        }
+    }
+}
+
+// sameInputs reports whether c reads the same game from the same sockets as o,
+// only the split type and debug logging differ
+func (c Config) sameInputs(o Config) bool {
+    c.Split, c.Debug = o.Split, o.Debug
+    return c == o
+}
+
+// Report returns the active configuration
+func (p *pipeline) Report() controlReport {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return controlReport{Config: p.config, Running: p.running, Active: util.GetStatus().Game}
+}
+
+// Close stops reading and recording for good, reporting false if the loop
+// did not stop within timeout. The session file is closed either way.
+func (p *pipeline) Close(timeout time.Duration) bool {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    stopped := !p.running || p.stop(timeout)
+    p.closeRecorder()
+    return stopped
+}
+
+// validConfig checks what can be checked before the running loop is stopped
+func validConfig(c Config) error {
+    if c.Port <= 0 || c.Port > 65535 {
+        return fmt.Errorf("invalid port %d", c.Port)
+    }
+    if c.Outsim < 0 || c.Outsim > 65535 {
+        return fmt.Errorf("invalid outsim port %d", c.Outsim)
+    }
+    if c.Split != "car" && c.Split != "class" && c.Split != "session" {
+        return fmt.Errorf("invalid split type %s", c.Split)
+    }
+    if c.Capture && game.GT7(c.Game) && c.Host == "" && c.Replay == "" {
+        return errors.New("GT7 needs the console IP address, set host")
+    }
+    return nil
+}
+
+// loadFormat reads the packet format of the configured game, nil when it is detected
+func loadFormat(c Config) (*util.Format, error) {
+    if strings.EqualFold(c.Game, game.Auto) {
+        return nil, nil
+    }
+
+    format, err := util.LoadFormat(util.FormatFile(c.Game), c.Debug)
+    if err != nil {
+        return nil, err
+    }
+
+    if c.Debug {
+        telemArray := format.AllFields()
+        log.Printf("Logging entire telemArray: \n%v", telemArray)
+        log.Printf("Processed %d util.Telemetry types OK!", len(telemArray))
+    }
+    return format, nil
+}
+
+// start opens the inputs and runs the loop, p.mu is held
+func (p *pipeline) start(format *util.Format) error {
+    c := p.config
+    if err := p.open(); err != nil {
+        for _, input := range p.inputs {
+            input.Close()
+        }
+        p.inputs, p.remote = nil, nil
+        return err
+    }
+
+    game.SetDebug(c.Debug)
+    if c.Debug {
+        log.Println("Debug mode enabled")
+        if format != nil {
+            log.Printf("Length of telemetry packet: %d bytes\n", format.Length)
+        }
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan error, 1)
+    p.running, p.cancel, p.done = true, cancel, done
+
+    source, autoDetect := p.source, strings.EqualFold(c.Game, game.Auto)
+    go func() {
+        err := run(ctx, c.Game, autoDetect, c.Split, source, format)
+        done <- err
+        if ctx.Err() == nil {
+            select {
+            case p.ended <- err:
+            default:
+            }
+        }
+    }()
+    return nil
+}
+
+// open sets up the sockets or the replayed session, p.mu is held
+func (p *pipeline) open() error {
+    c := p.config
+    var source util.PacketReader
+
+    if c.Replay != "" {
+        replayer, err := util.NewReplayer(c.Replay, c.ReplaySpeed, c.ReplaySeek, c.ReplayLoop)
+        if err != nil {
+            return err
+        }
+        p.inputs = append(p.inputs, replayer)
+        source = p.record(replayer)
+        if game.GT7(c.Game) {
+            // sessions hold the packets as the console sent them
+            source = game.NewGT7Reader(source)
+        }
+
+        log.Printf("Replaying session %s at %gx\n", c.Replay, c.ReplaySpeed)
+    } else {
+        // Setup UDP listener
+        listener, err := util.Listen(hostname + ":" + strconv.Itoa(c.Port))
+        if err != nil {
+            return err
+        }
+        p.inputs = append(p.inputs, listener)
+        source = listener
+
+        if c.Outsim != 0 && c.Outsim != c.Port {
+            outsim, err := util.Listen(hostname + ":" + strconv.Itoa(c.Outsim))
+            if err != nil {
+                return err
+            }
+            p.inputs = append(p.inputs, outsim)
+            merged := util.NewMergedReader(listener, outsim)
+            p.inputs = append(p.inputs, merged)
+            source = merged
+            log.Printf("Reading OutSim data on port %d\n", c.Outsim)
+        }
+
+        // Games that must be asked for telemetry talk through the recorder,
+        // so it stores the datagrams as the game sent them
+        source = p.record(source)
+        var conn util.UDPConn = listener
+        if p.recorder != nil {
+            conn = p.recorder
+        }
+
+        if game.GT7(c.Game) {
+            source, err = game.NewGT7Conn(conn, c.Host)
+            if err != nil {
+                return err
+            }
+            log.Printf("Requesting GT7 telemetry from %s\n", c.Host)
+        } else if c.Game == "AC" {
+            if c.Host == "" {
+                log.Println("Assetto Corsa only sends telemetry after a handshake, set -host to request it")
+            } else {
+                acConn, err := game.NewACConn(conn, c.Host)
+                if err != nil {
+                    return err
+                }
+                source = acConn
+                p.remote = acConn
+                log.Printf("Requesting Assetto Corsa telemetry from %s\n", c.Host)
+            }
+        } else if c.Game == "ACC" {
+            if c.Host == "" {
+                log.Println("ACC only sends broadcasting data to registered clients, set -host to register")
+            } else {
+                accConn, err := game.NewACCConn(conn, c.Host, c.Password)
+                if err != nil {
+                    return err
+                }
+                source = accConn
+                p.remote = accConn
+                log.Printf("Registering with ACC at %s\n", c.Host)
+            }
+        }
+
+        if c.Debug {
+            log.Printf("Telemetry data out server listening on %s:%d, waiting for data...\n", util.GetOutboundIP(), c.Port)
+        } else {
+            log.Printf("Reading data on port %d\n", c.Port)
+        }
+    }
+
+    p.source = source
+    return nil
+}
+
+// record passes the datagrams of source through the recorder when recording
+func (p *pipeline) record(source util.PacketReader) util.PacketReader {
+    if p.recorder == nil {
+        return source
+    }
+    p.recorder.SetSource(source)
+    return p.recorder
+}
+
+// closeRecorder ends the recording, p.mu is held
+func (p *pipeline) closeRecorder() {
+    if p.recorder == nil {
+        return
+    }
+    if err := p.recorder.Close(); err != nil {
+        log.Printf("Error closing session file: %v", err)
+    }
+    p.recorder = nil
+}
+
+// stop closes the inputs, waits for the loop and stores the odometer and
+// timing data, p.mu is held. It reports false if the loop did not stop within timeout.
+func (p *pipeline) stop(timeout time.Duration) bool {
+    p.cancel()
+    // The game is told we are leaving while the socket is still open
+    if p.remote != nil {
+        p.remote.Close()
+    }
+    for _, input := range p.inputs {
+        input.Close()
+    }
+    p.remote, p.inputs = nil, nil
+
+    select {
+    case <-p.done:
+    case <-time.After(timeout):
+        // The loop still owns the timing and odometer data, the pipeline
+        // stays running so no second loop starts. Stopping again waits for it.
+        log.Printf("Telemetry loop did not stop within %s", timeout)
+        return false
+    }
+
+    p.running = false
+    game.Flush()
+    util.SetIdle()
+    return true
+}
+
+// controlResponder reports the configuration on GET and changes it on POST
+// with a JSON object holding the fields to change. Changes are only taken
+// from this machine, the port is open to the network and a change can carry
+// the ACC password.
+func (p *pipeline) controlResponder(w http.ResponseWriter, r *http.Request) {
+    util.EnableCors(&w)
+    switch r.Method {
+    case "GET":
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(p.Report())
+    case "POST":
+        if !localRequest(r) {
+            http.Error(w, "configuration changes are only accepted from localhost", http.StatusForbidden)
+            log.Printf("Refused configuration change from %s", r.RemoteAddr)
+            return
+        }
+        // Browsers only send a JSON body after a CORS preflight, which fails,
+        // so pages open on this machine cannot change the configuration either
+        if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+            http.Error(w, "expected Content-Type application/json", http.StatusUnsupportedMediaType)
+            return
+        }
+
+        var change configChange
+        if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+            http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+
+        err := p.ApplyChange(change)
+        report := p.Report()
+
+        w.Header().Set("Content-Type", "application/json")
+        if err != nil {
+            report.Error = err.Error()
+            w.WriteHeader(http.StatusBadRequest)
+        }
+        json.NewEncoder(w).Encode(report)
+    default:
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        log.Printf("Not supported.")
+    }
+}
+
+// localRequest reports whether a request comes from this machine
+func localRequest(r *http.Request) bool {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return false
+    }
+    ip := net.ParseIP(host)
+    return ip != nil && ip.IsLoopback()
+}
+
+// with returns the configuration with the requested changes made
+func (c Config) with(change configChange) Config {
+    if change.Game != nil {
+        c.Game = strings.ToUpper(*change.Game)
+        if strings.EqualFold(c.Game, game.Auto) {
+            c.Game = game.Auto
+        }
+        // GT7 always sends to a fixed port
+        if game.GT7(c.Game) && change.Port == nil {
+            c.Port = game.GT7Port
+        }
+    }
+    if change.Split != nil {
+        c.Split = strings.ToLower(*change.Split)
+    }
+    if change.Port != nil {
+        c.Port = *change.Port
+    }
+    if change.Outsim != nil {
+        c.Outsim = *change.Outsim
+    }
+    if change.Host != nil {
+        c.Host = *change.Host
+    }
+    if change.Password != nil {
+        c.Password = *change.Password
+    }
+    if change.Debug != nil {
+        c.Debug = *change.Debug
+    }
+    if change.Capture != nil {
+        c.Capture = *change.Capture
+    }
+    return c
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+
+    "jesseboth/fdt/src/game"
+    "jesseboth/fdt/src/util"
+)
+
+// Datagram sizes the games send, formats may leave trailing bytes out but never ask for more
+var expectedSizes = map[string]int{
+    "FM":  331,
+    "FM7": 311,
+    "FH4": 324,
+    "FH5": 324,
+    "DR2": 264,
+    "AC":  328,
+    "GT7": 296,
+    "RBR": 664,
+}
+
+var pcarsSizes = map[int64]int{0: 559, 1: 308, 2: 1136, 3: 1063, 4: 24, 8: 1132}
+var outgaugeSizes = map[int64]int{64: 64, 92: 92}
+
+// Datagram sizes per packet kind of multi packet formats
+var expectedKindSizes = map[string]map[int64]int{
+    "F123": {0: 1349, 1: 644, 2: 1131, 6: 1352, 7: 1239},
+    "F124": {0: 1349, 1: 753, 2: 1285, 6: 1352, 7: 1239},
+    "PC2":  pcarsSizes,
+    "AMS2": pcarsSizes,
+    "BNG":  outgaugeSizes,
+    "LFS":  outgaugeSizes,
+}
+
+// formatCommand runs the format subcommands and returns the exit code
+func formatCommand(args []string) int {
+    if len(args) == 0 || args[0] != "check" {
+        fmt.Fprintln(os.Stderr, "Usage: fdt format check [-q] [-game ID] <file or game id> ...")
+        return 2
+    }
+
+    flags := flag.NewFlagSet("format check", flag.ExitOnError)
+    quiet := flags.Bool("q", false, "Only print problems")
+    gameSTR := flags.String("game", "", "Game the expected packet sizes are taken from, by default the file name prefix")
+    flags.Parse(args[1:])
+
+    if flags.NArg() == 0 {
+        fmt.Fprintln(os.Stderr, "Usage: fdt format check [-q] [-game ID] <file or game id> ...")
+        return 2
+    }
+
+    failed := 0
+    for _, file := range flags.Args() {
+        if _, err := os.Stat(file); err != nil && !strings.ContainsAny(file, "/.") {
+            file = util.FormatFile(file)
+        }
+        id := *gameSTR
+        if id == "" {
+            id = strings.TrimSuffix(filepath.Base(file), "_packetformat.dat")
+        }
+        if !checkFormat(file, id, *quiet) {
+            failed++
+        }
+    }
+
+    if failed > 0 {
+        fmt.Printf("%d of %d format files have errors\n", failed, flags.NArg())
+        return 1
+    }
+    return 0
+}
+
+// checkFormat loads a format file, prints its layout and reports whether it has no errors
+func checkFormat(file string, id string, quiet bool) bool {
+    format, err := util.LoadFormat(file, false)
+    if err != nil {
+        fmt.Printf("%s: error: %s\n", file, err)
+        return false
+    }
+
+    var errors, warnings []string
+    // lines LoadFormat skipped are mistakes in a file that is meant to be valid
+    errors = append(errors, format.Warnings...)
+
+    if !quiet {
+        name := game.Lookup(id).Describe(id)
+        fmt.Printf("%s: %s (%s)\n", file, id, name)
+    }
+
+    if !format.Multi() {
+        errors = append(errors, checkLayout(format.Fields)...)
+        warnings = append(warnings, checkOverlap(format.Fields)...)
+        if !quiet {
+            printLayout(format.Fields)
+        }
+        e, w := checkLength("", format.Length, expectedSizes[id])
+        errors, warnings = append(errors, e...), append(warnings, w...)
+        if !quiet {
+            fmt.Printf("  length %d%s\n", format.Length, expectedText(expectedSizes[id]))
+        }
+    } else {
+        if !quiet {
+            if format.Key == util.KeyLength {
+                fmt.Printf("  packet kinds by length\n")
+            } else {
+                fmt.Printf("  header, %d bytes, packet kind in %s\n", format.Length, format.Key)
+                printLayout(format.Fields)
+            }
+        }
+
+        // fields of every kind are merged into one state, the same name in two kinds overwrites
+        owner := make(map[string]string)
+        for _, kind := range format.Kinds {
+            errors = append(errors, checkLayout(kind.Fields)...)
+            warnings = append(warnings, checkOverlap(kind.Fields)...)
+
+            body := kind.Fields[len(format.Fields):]
+            for _, T := range body {
+                if other, ok := owner[T.Name]; ok && other != kind.Name {
+                    warnings = append(warnings, fmt.Sprintf("%s is read from packets %s and %s, the last one received wins", T.Name, other, kind.Name))
+                }
+                owner[T.Name] = kind.Name
+            }
+
+            expected := expectedKindSizes[id][kind.ID]
+            if !quiet {
+                fmt.Printf("  packet %d %s, %d bytes%s\n", kind.ID, kind.Name, kind.Length, expectedText(expected))
+                printLayout(body)
+            }
+            e, w := checkLength("packet "+kind.Name+" ", kind.Length, expected)
+            errors, warnings = append(errors, e...), append(warnings, w...)
+        }
+    }
+
+    if !quiet && len(format.Transforms) > 0 {
+        fmt.Printf("  transforms\n")
+        for _, transform := range format.Transforms {
+            fmt.Printf("    line %-4d %-7s %s\n", transform.Position, transform.Kind, transform)
+        }
+    }
+
+    for _, warning := range warnings {
+        fmt.Printf("%s: warning: %s\n", file, warning)
+    }
+    for _, err := range errors {
+        fmt.Printf("%s: error: %s\n", file, err)
+    }
+    if !quiet && len(errors) == 0 {
+        fmt.Printf("%s: OK\n", file)
+    }
+    return len(errors) == 0
+}
+
+// checkLayout flags names read twice from one datagram, only the last one would be kept
+func checkLayout(fields []util.Telemetry) []string {
+    var errors []string
+    seen := make(map[string]util.Telemetry)
+    for _, T := range fields {
+        if first, ok := seen[T.Name]; ok {
+            errors = append(errors, fmt.Sprintf("duplicate field %s on lines %d and %d", T.Name, first.Position, T.Position))
+            continue
+        }
+        seen[T.Name] = T
+    }
+    return errors
+}
+
+// checkOverlap flags fields sharing bytes, usually a wrong explicit offset
+func checkOverlap(fields []util.Telemetry) []string {
+    var warnings []string
+    for i, T := range fields {
+        for _, other := range fields[:i] {
+            if T.StartOffset < other.EndOffset && other.StartOffset < T.EndOffset && T.Name != other.Name {
+                warnings = append(warnings, fmt.Sprintf("%s (line %d) overlaps %s (line %d) at bytes %d:%d",
+                    T.Name, T.Position, other.Name, other.Position, T.StartOffset, T.EndOffset))
+            }
+        }
+    }
+    return warnings
+}
+
+// checkLength compares a layout length with the datagram size the game sends, 0 when unknown
+func checkLength(what string, length int, expected int) ([]string, []string) {
+    switch {
+    case expected == 0 || length == expected:
+        return nil, nil
+    case length > expected:
+        return []string{fmt.Sprintf("%slength %d is longer than the %d bytes the game sends", what, length, expected)}, nil
+    default:
+        return nil, []string{fmt.Sprintf("%slength %d leaves the last %d of %d bytes undescribed", what, length, expected-length, expected)}
+    }
+}
+
+func expectedText(expected int) string {
+    if expected == 0 {
+        return ", no expected size known"
+    }
+    return fmt.Sprintf(", game sends %d", expected)
+}
+
+func printLayout(fields []util.Telemetry) {
+    fmt.Printf("    %6s %6s %4s  %-6s %-6s %s\n", "offset", "end", "size", "type", "line", "name")
+    for _, T := range fields {
+        dataType := T.DataType
+        if T.BigEndian {
+            dataType += "be"
+        }
+        fmt.Printf("    %6d %6d %4d  %-6s %-6d %s\n", T.StartOffset, T.EndOffset, T.EndOffset-T.StartOffset, dataType, T.Position, T.Name)
+    }
+}
@@ -0,0 +1,217 @@
+package game
+
+import (
+    "encoding/binary"
+    "errors"
+    "log"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "unicode/utf16"
+
+    "jesseboth/fdt/src/util"
+)
+
+const (
+    ACPort = 9996 // UDP port Assetto Corsa accepts remote telemetry clients on
+
+    // operations of the handshaker struct
+    acHandshake       = 0
+    acSubscribeUpdate = 1
+    acDismiss         = 3
+
+    acDeviceIdentifier = 1 // eIPhoneDevice, the only device type AC knows
+    acVersion          = 1
+
+    acHandshakeSize = 408 // handshake response: car, driver, track and config names
+    acNameSize      = 100 // 50 UTF-16 characters
+
+    // Handshake again when AC is quiet, it forgets clients on session restarts
+    acRetry   = time.Second
+    acTimeout = 3 * time.Second
+)
+
+// Names from the last handshake response, added to every packet
+var acNames = struct {
+    sync.Mutex
+    car, driver, track, config string
+}{}
+
+// ac handles Assetto Corsa
+type ac struct {
+    baseGame
+}
+
+func init() {
+    Register(ac{})
+}
+
+func (ac) Identify(game string) bool {
+    return game == "AC"
+}
+
+func (ac) Describe(game string) string {
+    return "Assetto Corsa"
+}
+
+// Decode keeps the names of handshake responses, everything else is RTCarInfo
+func (ac) Decode(data []byte, telemArray []util.Telemetry, packet *Packet, debug bool) bool {
+    if len(data) != acHandshakeSize {
+        DecodePacket(packet, data, telemArray, debug)
+        return true
+    }
+
+    car, driver, track, config := acParseHandshake(data)
+    acNames.Lock()
+    acNames.car, acNames.driver, acNames.track, acNames.config = car, driver, track, config
+    acNames.Unlock()
+    log.Printf("AC handshake: %s driving %s on %s %s", driver, car, track, config)
+    return false
+}
+
+func (ac) PostProcess(game string, packet *Packet, debug bool) bool {
+    packet.SetBool("IsRaceOn", true)
+    packet.SetS32("GearNeutral", 1)
+    packet.SetS32("GearReverse", 0)
+
+    acNames.Lock()
+    packet.SetStr("CarName", acNames.car)
+    packet.SetStr("DriverName", acNames.driver)
+    packet.SetStr("TrackName", acNames.track)
+    packet.SetStr("TrackConfig", acNames.config)
+    acNames.Unlock()
+
+    return true
+}
+
+func (ac) Fields(game string, decoded []Field) []Field {
+    return withFields(withFields(decoded, raceOnFields...),
+        Field{"CarName", "str", ""},
+        Field{"DriverName", "str", ""},
+        Field{"TrackName", "str", ""},
+        Field{"TrackConfig", "str", ""},
+    )
+}
+
+// Pedals are 0..1, the format file converts speed and lap times
+func (ac) Mapping(game string) Mapping {
+    return baseMapping.With(Mapping{
+        "throttle":  {Key: "Accel"},
+        "brake":     {Key: "Brake"},
+        "clutch":    {Key: "Clutch"},
+        "handbrake": {},
+        "steer":     {Key: "Steer"},
+    })
+}
+
+// acParseHandshake reads the names out of a handshake response
+func acParseHandshake(data []byte) (car string, driver string, track string, config string) {
+    car = acString(data[0:acNameSize])
+    driver = acString(data[acNameSize : 2*acNameSize])
+    // identifier and version follow the driver name
+    track = acString(data[2*acNameSize+8 : 3*acNameSize+8])
+    config = acString(data[3*acNameSize+8 : 4*acNameSize+8])
+    return
+}
+
+// acString decodes a UTF-16 name, AC ends them with '%' followed by garbage
+func acString(data []byte) string {
+    chars := make([]uint16, 0, len(data)/2)
+    for i := 0; i+1 < len(data); i += 2 {
+        c := binary.LittleEndian.Uint16(data[i:])
+        if c == 0 {
+            break
+        }
+        chars = append(chars, c)
+    }
+    name := string(utf16.Decode(chars))
+    if i := strings.IndexByte(name, '%'); i >= 0 {
+        name = name[:i]
+    }
+    return strings.TrimSpace(name)
+}
+
+// ACConn performs the Assetto Corsa handshake, subscribes to car updates
+// and returns the handshake response followed by the RTCarInfo packets.
+type ACConn struct {
+    conn   util.UDPConn
+    server *net.UDPAddr
+
+    subscribed bool
+    sent       time.Time // last handshake sent
+    received   time.Time // last datagram from AC
+}
+
+// NewACConn talks to Assetto Corsa on host from conn
+func NewACConn(conn util.UDPConn, host string) (*ACConn, error) {
+    addr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(host, strconv.Itoa(ACPort)))
+    if err != nil {
+        return nil, err
+    }
+    return &ACConn{
+        conn:   conn,
+        server: addr,
+    }, nil
+}
+
+func (c *ACConn) send(operation uint32) error {
+    var handshaker [12]byte
+    binary.LittleEndian.PutUint32(handshaker[0:], acDeviceIdentifier)
+    binary.LittleEndian.PutUint32(handshaker[4:], acVersion)
+    binary.LittleEndian.PutUint32(handshaker[8:], operation)
+    _, err := c.conn.WriteToUDP(handshaker[:], c.server)
+    return err
+}
+
+// ReadFromUDP returns the next datagram from AC, handshaking whenever AC is quiet
+func (c *ACConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+    for {
+        if c.subscribed && time.Since(c.received) > acTimeout {
+            log.Printf("No data from Assetto Corsa at %s, handshaking again", c.server)
+            c.subscribed = false
+        }
+        if !c.subscribed && time.Since(c.sent) >= acRetry {
+            if err := c.send(acHandshake); err != nil {
+                log.Printf("Error sending AC handshake to %s: %v", c.server, err)
+            } else if Debugging() {
+                log.Printf("AC handshake sent to %s", c.server)
+            }
+            c.sent = time.Now()
+        }
+
+        deadline := c.sent.Add(acRetry)
+        if c.subscribed {
+            deadline = c.received.Add(acTimeout)
+        }
+        c.conn.SetReadDeadline(deadline)
+
+        n, addr, err := c.conn.ReadFromUDP(b)
+        var netErr net.Error
+        if errors.As(err, &netErr) && netErr.Timeout() {
+            continue
+        } else if err != nil {
+            return n, addr, err
+        }
+        c.received = time.Now()
+
+        if n == acHandshakeSize {
+            if err := c.send(acSubscribeUpdate); err != nil {
+                log.Printf("Error subscribing to AC updates: %v", err)
+                continue
+            }
+            c.subscribed = true
+        } else if !c.subscribed {
+            // Updates from a subscription we did not make in this run
+            c.subscribed = true
+        }
+        return n, addr, nil
+    }
+}
+
+// Close tells AC to stop sending updates
+func (c *ACConn) Close() error {
+    log.Printf("Dismissing Assetto Corsa connection to %s", c.server)
+    return c.send(acDismiss)
+}
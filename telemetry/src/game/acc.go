@@ -0,0 +1,701 @@
+package game
+
+import (
+    "encoding/binary"
+    "errors"
+    "log"
+    "math"
+    "net"
+    "sort"
+    "strconv"
+    "time"
+
+    "jesseboth/fdt/src/util"
+)
+
+const (
+    ACCPort = 9000 // default broadcasting port, udpListenerPort in broadcasting.json
+
+    accProtocolVersion = 4
+    accDisplayName     = "fdt"
+    accUpdateInterval  = 50 // ms between realtime updates
+
+    // outbound messages
+    accRegister         = 1
+    accUnregister       = 9
+    accRequestEntryList = 10
+    accRequestTrackData = 11
+
+    // inbound messages
+    accRegistrationResult = 1
+    accRealtimeUpdate     = 2
+    accRealtimeCarUpdate  = 3
+    accEntryList          = 4
+    accTrackData          = 5
+    accEntryListCar       = 6
+    accBroadcastingEvent  = 7
+
+    accNoTime = math.MaxInt32 // lap and split times that are not set
+
+    // Register again when ACC is quiet, ie: after a restart
+    accRetry   = time.Second
+    accTimeout = 5 * time.Second
+)
+
+var accSessionTypes = map[uint8]string{
+    0:  "Practice",
+    4:  "Qualifying",
+    9:  "Superpole",
+    10: "Race",
+    11: "Hotlap",
+    12: "Hotstint",
+    13: "HotlapSuperpole",
+    14: "Replay",
+}
+
+var accSessionPhases = map[uint8]string{
+    0: "None",
+    1: "Starting",
+    2: "PreFormation",
+    3: "FormationLap",
+    4: "PreSession",
+    5: "Session",
+    6: "SessionOver",
+    7: "PostSession",
+    8: "ResultUI",
+}
+
+var accCarLocations = map[uint8]string{
+    0: "None",
+    1: "Track",
+    2: "Pitlane",
+    3: "PitEntry",
+    4: "PitExit",
+}
+
+// Names of the current, last and best time of every sector
+var accSectors = func() [3][3]string {
+    var names [3][3]string
+    for i := range names {
+        sector := strconv.Itoa(i + 1)
+        names[i] = [3]string{"CurrentSector" + sector, "LastSector" + sector, "BestSector" + sector}
+    }
+    return names
+}()
+
+// accLap is a lap info, times in seconds and 0 when not set
+type accLap struct {
+    Time    float32
+    Splits  [3]float32
+    Invalid bool
+    Outlap  bool
+    Inlap   bool
+}
+
+type accDriver struct {
+    FirstName string
+    LastName  string
+    ShortName string
+}
+
+// accCar combines the entry list with the latest realtime update of a car
+type accCar struct {
+    listed      bool   // entry list details received
+    name        string // of the driver in the car, see driver
+    RaceNumber  int32
+    Team        string
+    Model       uint8
+    CupCategory uint8
+    DriverIndex uint8
+    Drivers     []accDriver
+
+    Gear          int8
+    Kmh           uint16
+    Location      uint8
+    Position      uint16
+    CupPosition   uint16
+    TrackPosition uint16
+    Spline        float32
+    Laps          uint16
+    Delta         int32
+    Best          accLap
+    Last          accLap
+    Current       accLap
+}
+
+// driver returns the name of the driver in the car
+func (c *accCar) driver() string {
+    if int(c.DriverIndex) >= len(c.Drivers) {
+        return ""
+    }
+    d := c.Drivers[c.DriverIndex]
+    return d.FirstName + " " + d.LastName
+}
+
+// accStanding is one row of the published standings
+type accStanding struct {
+    Position   uint16
+    CarIndex   uint16
+    RaceNumber int32
+    Driver     string
+    Team       string
+    Laps       uint16
+    LastLap    float32
+    BestLap    float32
+    Location   string
+}
+
+// Session state, kept across messages
+var accSession = struct {
+    track          string
+    trackMeters    int32
+    focused        int32
+    sessionType    uint8
+    phase          uint8
+    sessionTime    float32
+    sessionEndTime float32
+    ambientTemp    uint8
+    trackTemp      uint8
+    best           accLap
+    cars           map[uint16]*accCar
+    standings      accStandings
+    entryListStale bool // a car is missing from the entry list, ask for a new one
+}{
+    focused: -1,
+    cars:    make(map[uint16]*accCar),
+}
+
+// Broadcasting message being read, the published packet is built from the session
+var accMessage = NewPacket(nil)
+
+// acc handles Assetto Corsa Competizione
+type acc struct {
+    baseGame
+}
+
+func init() {
+    Register(acc{})
+}
+
+func (acc) Identify(game string) bool {
+    return game == "ACC"
+}
+
+func (acc) Describe(game string) string {
+    return "Assetto Corsa Competizione"
+}
+
+// Decode updates the session with a broadcasting message. Only updates of
+// the focused car are published, every other message is skipped.
+func (acc) Decode(data []byte, telemArray []util.Telemetry, out *Packet, debug bool) bool {
+    packet := accMessage
+    packet.Reset()
+    DecodePacket(packet, data, telemArray, debug)
+
+    // the format file describes the fixed start of the message
+    r := &accReader{data: data}
+    for _, T := range telemArray {
+        if T.EndOffset > r.pos {
+            r.pos = T.EndOffset
+        }
+    }
+
+    switch packet.U8("MessageType") {
+    case accRealtimeUpdate:
+        accSession.sessionType = packet.U8("SessionType")
+        accSession.phase = packet.U8("SessionPhase")
+        accSession.sessionTime = packet.F32("SessionTime") / 1000
+        accSession.sessionEndTime = packet.F32("SessionEndTime") / 1000
+        accSession.focused = packet.S32("FocusedCarIndex")
+
+        r.str() // active camera set
+        r.str() // active camera
+        r.str() // HUD page
+        if r.u8() != 0 {
+            r.f32() // replay session time
+            r.f32() // replay remaining time
+        }
+        r.f32() // time of day
+        ambient, track := r.u8(), r.u8()
+        r.u8() // clouds
+        r.u8() // rain
+        r.u8() // wetness
+        best := r.lap()
+        if r.ok() {
+            accSession.ambientTemp, accSession.trackTemp = ambient, track
+            accSession.best = best
+        }
+
+    case accRealtimeCarUpdate:
+        index := packet.U16("CarIndex")
+        car, ok := accSession.cars[index]
+        if !ok {
+            car = &accCar{}
+            accSession.cars[index] = car
+        }
+        if !car.listed || int(packet.U8("DriverCount")) != len(car.Drivers) {
+            accSession.entryListStale = true
+        }
+
+        car.Gear = int8(int(packet.U8("Gear")) - 2)
+        car.Kmh = packet.U16("SpeedKmh")
+        car.Location = packet.U8("CarLocation")
+        car.Position = packet.U16("RacePosition")
+        car.CupPosition = packet.U16("CupPosition")
+        car.TrackPosition = packet.U16("TrackPosition")
+        car.Spline = packet.F32("CarPositionNormalized")
+        car.Laps = packet.U16("Laps")
+        car.Delta = packet.S32("Delta")
+        best, last, current := r.lap(), r.lap(), r.lap()
+        if r.ok() {
+            car.Best, car.Last, car.Current = best, last, current
+        }
+
+        if int32(index) == accSession.focused {
+            accPacket(index, packet, out)
+            return true
+        }
+
+    case accEntryList:
+        count := int(packet.U16("CarCount"))
+        listed := make(map[uint16]*accCar)
+        for i := 0; i < count && r.ok(); i++ {
+            index := r.u16()
+            if car, ok := accSession.cars[index]; ok {
+                listed[index] = car
+            } else {
+                listed[index] = &accCar{}
+            }
+        }
+        if r.ok() {
+            accSession.cars = listed
+        }
+
+    case accTrackData:
+        name := r.str()
+        r.s32() // track id
+        meters := r.s32()
+        if r.ok() {
+            accSession.track, accSession.trackMeters = name, meters
+            log.Printf("ACC track: %s (%d m)", name, meters)
+        }
+
+    case accEntryListCar:
+        car := &accCar{Model: packet.U8("CarModelType")}
+        car.Team = r.str()
+        car.RaceNumber = r.s32()
+        car.CupCategory = r.u8()
+        car.DriverIndex = r.u8()
+        r.u16() // nationality
+        drivers := int(r.u8())
+        for i := 0; i < drivers && r.ok(); i++ {
+            var d accDriver
+            d.FirstName, d.LastName, d.ShortName = r.str(), r.str(), r.str()
+            r.u8()  // category
+            r.u16() // nationality
+            car.Drivers = append(car.Drivers, d)
+        }
+        if !r.ok() {
+            break
+        }
+
+        index := packet.U16("CarIndex")
+        if old, ok := accSession.cars[index]; ok {
+            // keep the realtime state
+            old.listed, old.RaceNumber, old.Team, old.Model = true, car.RaceNumber, car.Team, car.Model
+            old.CupCategory, old.DriverIndex, old.Drivers = car.CupCategory, car.DriverIndex, car.Drivers
+            old.name = old.driver()
+        } else {
+            car.listed, car.name = true, car.driver()
+            accSession.cars[index] = car
+        }
+
+    case accBroadcastingEvent:
+        if debug {
+            log.Printf("ACC event %d: %s", packet.U8("EventType"), r.str())
+        }
+    }
+
+    return false
+}
+
+func (acc) PostProcess(game string, packet *Packet, debug bool) bool {
+    packet.SetBool("IsRaceOn", true)
+    packet.SetS32("GearNeutral", 0)
+    packet.SetS32("GearReverse", -1)
+    return true
+}
+
+// Fields are the values of accPacket, the broadcasting messages are not published
+func (acc) Fields(game string, decoded []Field) []Field {
+    fields := []Field{
+        {"Gear", "s8", ""},
+        {"SpeedKmh", "u16", "km/h"},
+        {"Speed", "f32", "m/s"},
+        {"PositionX", "f32", "m"},
+        {"PositionY", "f32", "m"},
+        {"Yaw", "f32", ""},
+        {"RacePosition", "u16", ""},
+        {"CupPosition", "u16", ""},
+        {"TrackPosition", "u16", ""},
+        {"CarPositionNormalized", "f32", "0..1"},
+        {"LapNumber", "u16", ""},
+        {"Delta", "f32", "s"},
+        {"CurrentLap", "f32", "s"},
+        {"LastLap", "f32", "s"},
+        {"BestLap", "f32", "s"},
+        {"SessionBestLap", "f32", "s"},
+        {"IsInPit", "bool", ""},
+        {"LapInvalid", "bool", ""},
+    }
+    for _, names := range accSectors {
+        for _, name := range names {
+            fields = append(fields, Field{name, "f32", "s"})
+        }
+    }
+    fields = append(fields, []Field{
+        {"CarIndex", "u16", ""},
+        {"RaceNumber", "s32", ""},
+        {"TeamName", "str", ""},
+        {"DriverName", "str", ""},
+        {"CarModel", "u8", ""},
+        {"CarLocation", "str", ""},
+        {"TrackName", "str", ""},
+        {"TrackMeters", "s32", "m"},
+        {"SessionType", "str", ""},
+        {"SessionPhase", "str", ""},
+        {"SessionTime", "f32", "s"},
+        {"SessionTimeLeft", "f32", "s"},
+        {"AmbientTemp", "u8", "C"},
+        {"TrackTemp", "u8", "C"},
+        {"Standings", "array", ""},
+    }...)
+    return append(fields, raceOnFields...)
+}
+
+// accPacket fills packet with the focused car along with the session and standings
+func accPacket(index uint16, update *Packet, packet *Packet) {
+    car := accSession.cars[index]
+
+    packet.SetS8("Gear", car.Gear)
+    packet.SetU16("SpeedKmh", car.Kmh)
+    packet.SetF32("Speed", float32(car.Kmh) / 3.6)
+    packet.SetF32("PositionX", update.F32("PositionX"))
+    packet.SetF32("PositionY", update.F32("PositionY"))
+    packet.SetF32("Yaw", update.F32("Yaw"))
+    packet.SetU16("RacePosition", car.Position)
+    packet.SetU16("CupPosition", car.CupPosition)
+    packet.SetU16("TrackPosition", car.TrackPosition)
+    packet.SetF32("CarPositionNormalized", car.Spline)
+    packet.SetU16("LapNumber", car.Laps)
+    packet.SetF32("Delta", float32(car.Delta) / 1000)
+    packet.SetF32("CurrentLap", car.Current.Time)
+    packet.SetF32("LastLap", car.Last.Time)
+    packet.SetF32("BestLap", car.Best.Time)
+    packet.SetF32("SessionBestLap", accSession.best.Time)
+    packet.SetBool("IsInPit", car.Location == 2)
+    packet.SetBool("LapInvalid", car.Current.Invalid)
+    for i, names := range accSectors {
+        packet.SetF32(names[0], car.Current.Splits[i])
+        packet.SetF32(names[1], car.Last.Splits[i])
+        packet.SetF32(names[2], car.Best.Splits[i])
+    }
+
+    packet.SetU16("CarIndex", index)
+    packet.SetS32("RaceNumber", car.RaceNumber)
+    packet.SetStr("TeamName", car.Team)
+    packet.SetStr("DriverName", car.name)
+    packet.SetU8("CarModel", car.Model)
+    packet.SetStr("CarLocation", accCarLocations[car.Location])
+    packet.SetStr("TrackName", accSession.track)
+    packet.SetS32("TrackMeters", accSession.trackMeters)
+    packet.SetStr("SessionType", accSessionTypes[accSession.sessionType])
+    packet.SetStr("SessionPhase", accSessionPhases[accSession.phase])
+    packet.SetF32("SessionTime", accSession.sessionTime)
+    packet.SetF32("SessionTimeLeft", accSession.sessionEndTime)
+    packet.SetU8("AmbientTemp", accSession.ambientTemp)
+    packet.SetU8("TrackTemp", accSession.trackTemp)
+
+    accSession.standings.update()
+    packet.SetObject("Standings", &accSession.standings)
+}
+
+// accStandings lists every car by position, cars without a position last.
+// The rows are rebuilt in place for every published packet.
+type accStandings struct {
+    rows []accStanding
+}
+
+func (s *accStandings) update() {
+    s.rows = s.rows[:0]
+    for index, car := range accSession.cars {
+        s.rows = append(s.rows, accStanding{
+            Position:   car.Position,
+            CarIndex:   index,
+            RaceNumber: car.RaceNumber,
+            Driver:     car.name,
+            Team:       car.Team,
+            Laps:       car.Laps,
+            LastLap:    car.Last.Time,
+            BestLap:    car.Best.Time,
+            Location:   accCarLocations[car.Location],
+        })
+    }
+    sort.Sort(s)
+}
+
+func (s *accStandings) Len() int {
+    return len(s.rows)
+}
+
+func (s *accStandings) Less(i, j int) bool {
+    a, b := &s.rows[i], &s.rows[j]
+    if (a.Position == 0) != (b.Position == 0) {
+        return b.Position == 0
+    }
+    if a.Position != b.Position {
+        return a.Position < b.Position
+    }
+    return a.CarIndex < b.CarIndex
+}
+
+func (s *accStandings) Swap(i, j int) {
+    s.rows[i], s.rows[j] = s.rows[j], s.rows[i]
+}
+
+// AppendJSON writes the rows as an array of objects, keys named like the accStanding fields
+func (s *accStandings) AppendJSON(b []byte) []byte {
+    b = append(b, '[')
+    for i := range s.rows {
+        row := &s.rows[i]
+        if i > 0 {
+            b = append(b, ',')
+        }
+        b = append(b, `{"Position":`...)
+        b = strconv.AppendUint(b, uint64(row.Position), 10)
+        b = append(b, `,"CarIndex":`...)
+        b = strconv.AppendUint(b, uint64(row.CarIndex), 10)
+        b = append(b, `,"RaceNumber":`...)
+        b = strconv.AppendInt(b, int64(row.RaceNumber), 10)
+        b = append(b, `,"Driver":`...)
+        b = appendString(b, row.Driver)
+        b = append(b, `,"Team":`...)
+        b = appendString(b, row.Team)
+        b = append(b, `,"Laps":`...)
+        b = strconv.AppendUint(b, uint64(row.Laps), 10)
+        b = append(b, `,"LastLap":`...)
+        b = appendFloat(b, float64(row.LastLap), 32)
+        b = append(b, `,"BestLap":`...)
+        b = appendFloat(b, float64(row.BestLap), 32)
+        b = append(b, `,"Location":`...)
+        b = appendString(b, row.Location)
+        b = append(b, '}')
+    }
+    return append(b, ']')
+}
+
+// accReader reads the variable length part of a message, reads past the end return zero
+type accReader struct {
+    data []byte
+    pos  int
+    err  bool
+}
+
+func (r *accReader) ok() bool {
+    return !r.err
+}
+
+func (r *accReader) next(n int) []byte {
+    if r.err || r.pos+n > len(r.data) {
+        r.err = true
+        return make([]byte, n)
+    }
+    b := r.data[r.pos : r.pos+n]
+    r.pos += n
+    return b
+}
+
+func (r *accReader) u8() uint8 {
+    return r.next(1)[0]
+}
+
+func (r *accReader) u16() uint16 {
+    return binary.LittleEndian.Uint16(r.next(2))
+}
+
+func (r *accReader) s32() int32 {
+    return int32(binary.LittleEndian.Uint32(r.next(4)))
+}
+
+func (r *accReader) f32() float32 {
+    return util.Float32frombytes(r.next(4))
+}
+
+func (r *accReader) str() string {
+    return string(r.next(int(r.u16())))
+}
+
+func (r *accReader) lap() accLap {
+    var lap accLap
+    ms := r.s32()
+    r.u16() // car index
+    r.u16() // driver index
+    splits := int(r.u8())
+    for i := 0; i < splits; i++ {
+        split := r.s32()
+        if i < len(lap.Splits) {
+            lap.Splits[i] = accTime(split)
+        }
+    }
+    lap.Invalid = r.u8() != 0
+    r.u8() // valid for best
+    lap.Outlap = r.u8() != 0
+    lap.Inlap = r.u8() != 0
+    lap.Time = accTime(ms)
+    return lap
+}
+
+// accTime converts milliseconds to seconds, unset times are 0
+func accTime(ms int32) float32 {
+    if ms == accNoTime || ms < 0 {
+        return 0
+    }
+    return float32(ms) / 1000
+}
+
+// ACCConn registers with the ACC broadcasting interface and returns every
+// message it sends. It asks for the entry list and track data after
+// registering, and again whenever the decoder sees an unknown car.
+type ACCConn struct {
+    conn     util.UDPConn
+    server   *net.UDPAddr
+    password string
+
+    connectionID int32
+    registered   bool
+    sent         time.Time // last registration sent
+    received     time.Time // last message from ACC
+    requested    time.Time // last entry list request
+}
+
+// NewACCConn registers with ACC on host, which may include a port, using the connection password
+func NewACCConn(conn util.UDPConn, host string, password string) (*ACCConn, error) {
+    if _, _, err := net.SplitHostPort(host); err != nil {
+        host = net.JoinHostPort(host, strconv.Itoa(ACCPort))
+    }
+    addr, err := net.ResolveUDPAddr("udp4", host)
+    if err != nil {
+        return nil, err
+    }
+    return &ACCConn{
+        conn:         conn,
+        server:       addr,
+        password:     password,
+        connectionID: -1,
+    }, nil
+}
+
+func (c *ACCConn) send(message []byte) {
+    if _, err := c.conn.WriteToUDP(message, c.server); err != nil {
+        log.Printf("Error sending to ACC at %s: %v", c.server, err)
+    }
+}
+
+func (c *ACCConn) request(messageType byte) {
+    message := []byte{messageType, 0, 0, 0, 0}
+    binary.LittleEndian.PutUint32(message[1:], uint32(c.connectionID))
+    c.send(message)
+}
+
+func (c *ACCConn) register() {
+    message := []byte{accRegister, accProtocolVersion}
+    message = appendACCString(message, accDisplayName)
+    message = appendACCString(message, c.password)
+    var interval [4]byte
+    binary.LittleEndian.PutUint32(interval[:], accUpdateInterval)
+    message = append(message, interval[:]...)
+    message = appendACCString(message, "") // command password, fdt only listens
+    c.send(message)
+    if Debugging() {
+        log.Printf("ACC registration sent to %s", c.server)
+    }
+}
+
+// registrationResult handles the answer to a registration
+func (c *ACCConn) registrationResult(data []byte) {
+    r := &accReader{data: data, pos: 1}
+    id := r.s32()
+    success := r.u8() != 0
+    r.u8() // read only
+    message := r.str()
+
+    if !success {
+        log.Printf("ACC refused the registration: %s", message)
+        // wait before trying again, the password will not fix itself
+        c.sent = time.Now().Add(accTimeout)
+        return
+    }
+
+    log.Printf("Registered with ACC at %s as connection %d", c.server, id)
+    c.connectionID = id
+    c.registered = true
+    c.request(accRequestEntryList)
+    c.request(accRequestTrackData)
+    c.requested = time.Now()
+}
+
+// ReadFromUDP returns the next message from ACC, registering whenever ACC is quiet
+func (c *ACCConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+    for {
+        if c.registered && time.Since(c.received) > accTimeout {
+            log.Printf("No data from ACC at %s, registering again", c.server)
+            c.registered = false
+        }
+        if !c.registered && time.Since(c.sent) >= accRetry {
+            c.register()
+            c.sent = time.Now()
+        }
+        if c.registered && accSession.entryListStale && time.Since(c.requested) >= accRetry {
+            c.request(accRequestEntryList)
+            c.requested = time.Now()
+            accSession.entryListStale = false
+        }
+
+        deadline := c.sent.Add(accRetry)
+        if c.registered {
+            deadline = c.received.Add(accTimeout)
+        }
+        c.conn.SetReadDeadline(deadline)
+
+        n, addr, err := c.conn.ReadFromUDP(b)
+        var netErr net.Error
+        if errors.As(err, &netErr) && netErr.Timeout() {
+            continue
+        } else if err != nil {
+            return n, addr, err
+        }
+        c.received = time.Now()
+
+        if n > 0 && b[0] == accRegistrationResult {
+            c.registrationResult(b[:n])
+        }
+        return n, addr, nil
+    }
+}
+
+// Close unregisters from ACC
+func (c *ACCConn) Close() error {
+    if c.connectionID < 0 {
+        return nil
+    }
+    log.Printf("Unregistering from ACC at %s", c.server)
+    c.request(accUnregister)
+    return nil
+}
+
+// appendACCString appends a string the way the broadcasting protocol sends them
+func appendACCString(b []byte, s string) []byte {
+    var length [2]byte
+    binary.LittleEndian.PutUint16(length[:], uint16(len(s)))
+    return append(append(b, length[:]...), s...)
+}
@@ -0,0 +1,114 @@
+package game_test
+
+import (
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "jesseboth/fdt/src/game"
+    "jesseboth/fdt/src/sim"
+    "jesseboth/fdt/src/util"
+)
+
+// Allocations allowed per decoded datagram once every value has been seen
+const maxAllocsPerPacket = 0
+
+// formatDir is the absolute packets directory, tests run in a temporary
+// directory so games store odometers and splits there
+var formatDir string
+
+func TestMain(m *testing.M) {
+    dir, err := filepath.Abs(filepath.Join("..", "..", util.FormatDir))
+    if err != nil {
+        log.Fatal(err)
+    }
+    formatDir = dir
+
+    data, err := os.MkdirTemp("", "fdt-game")
+    if err != nil {
+        log.Fatal(err)
+    }
+    if err := os.Chdir(data); err != nil {
+        log.Fatal(err)
+    }
+
+    // games log car and lap changes
+    log.SetOutput(io.Discard)
+    code := m.Run()
+    os.RemoveAll(data)
+    os.Exit(code)
+}
+
+// games returns the id of every game with a packet format file
+func games(t testing.TB) []string {
+    files, err := filepath.Glob(filepath.Join(formatDir, "*_packetformat.dat"))
+    if err != nil || len(files) == 0 {
+        t.Fatalf("no packet format files in %s", formatDir)
+    }
+    var ids []string
+    for _, file := range files {
+        ids = append(ids, strings.TrimSuffix(filepath.Base(file), "_packetformat.dat"))
+    }
+    return ids
+}
+
+func loadFormat(t testing.TB, file string) *util.Format {
+    format, err := util.LoadFormat(file, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return format
+}
+
+// datagrams drives the simulated car for frames and returns every datagram the game would send
+func datagrams(id string, format *util.Format, frames int) [][]byte {
+    car := sim.NewCar(3000)
+    var packets [][]byte
+    for i := 0; i < frames; i++ {
+        car.Step(1.0 / 60)
+        values := car.Values()
+        sim.Adjust(id, values)
+        packets = append(packets, sim.Packets(values, format)...)
+    }
+    return packets
+}
+
+func BenchmarkDecoderHandle(b *testing.B) {
+    for _, id := range games(b) {
+        format := loadFormat(b, filepath.Join(formatDir, id+"_packetformat.dat"))
+        packets := datagrams(id, format, 600)
+        decoder := game.NewDecoder(id, format)
+
+        b.Run(id, func(b *testing.B) {
+            b.ReportAllocs()
+            for i := 0; i < b.N; i++ {
+                decoder.Handle(packets[i%len(packets)])
+            }
+        })
+    }
+}
+
+func TestDecoderAllocs(t *testing.T) {
+    for _, id := range games(t) {
+        format := loadFormat(t, filepath.Join(formatDir, id+"_packetformat.dat"))
+        packets := datagrams(id, format, 600)
+        decoder := game.NewDecoder(id, format)
+
+        // the first lap grows the packets and stores the odometer
+        for _, packet := range packets {
+            decoder.Handle(packet)
+        }
+
+        i := 0
+        allocs := testing.AllocsPerRun(len(packets), func() {
+            decoder.Handle(packets[i%len(packets)])
+            i++
+        })
+        if allocs > maxAllocsPerPacket {
+            t.Errorf("%s: %.2f allocations per packet, want at most %d", id, allocs, maxAllocsPerPacket)
+        }
+    }
+}
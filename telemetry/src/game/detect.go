@@ -0,0 +1,280 @@
+package game
+
+import (
+    "fmt"
+    "log"
+    "math"
+    "path/filepath"
+    "sort"
+    "strings"
+
+    "jesseboth/fdt/src/util"
+)
+
+// Auto is the game id that asks fdt to detect the game from incoming packets
+const Auto = "auto"
+
+const detectSamples = 10 // datagrams scored before locking onto a game
+
+// Size of the datagrams the games actually send, which can be longer than
+// the fields described by the format file
+var wireSizes = map[string]int{
+    "FM":  331,
+    "FM7": 311,
+    "FH4": 324,
+    "FH5": 324,
+    "DR2": 264,
+    "AC":  328,
+}
+
+// FH4 and FH5 share a layout, as do AMS2 and PC2 and BNG and LFS, ties go to the game listed first
+var detectPreference = []string{"FM", "FH5", "FH4", "FM7", "DR2", "DR", "WRC", "RBR", "AC", "ACC", "F124", "F123", "AMS2", "PC2", "BNG", "LFS"}
+
+// Candidate is a game whose format file could describe the incoming packets
+type Candidate struct {
+    Game   string
+    Format *util.Format
+
+    score   float64
+    samples int
+}
+
+// Detector scores incoming datagrams against every known packet format
+type Detector struct {
+    candidates []*Candidate
+    samples    int
+}
+
+// NewDetector loads all packet format files in dir
+func NewDetector(dir string) (*Detector, error) {
+    files, err := filepath.Glob(filepath.Join(dir, "*_packetformat.dat"))
+    if err != nil {
+        return nil, err
+    }
+
+    d := &Detector{}
+    for _, file := range files {
+        id := strings.TrimSuffix(filepath.Base(file), "_packetformat.dat")
+        format, err := util.LoadFormat(file, false)
+        if err != nil {
+            log.Printf("Skipping %s for detection: %s", file, err)
+            continue
+        }
+        d.candidates = append(d.candidates, &Candidate{
+            Game:   id,
+            Format: format,
+        })
+    }
+
+    if len(d.candidates) == 0 {
+        return nil, fmt.Errorf("no packet formats found in %s", dir)
+    }
+
+    sort.SliceStable(d.candidates, func(i, j int) bool {
+        return preference(d.candidates[i].Game) < preference(d.candidates[j].Game)
+    })
+    return d, nil
+}
+
+func preference(game string) int {
+    for i, id := range detectPreference {
+        if id == game {
+            return i
+        }
+    }
+    return len(detectPreference)
+}
+
+// Add scores a datagram against every candidate
+func (d *Detector) Add(data []byte) {
+    d.samples++
+    for _, c := range d.candidates {
+        telemArray, totalLength, ok := c.Format.Layout(data)
+        if !ok {
+            // Packet kind the format does not describe, no evidence either way
+            c.samples++
+            continue
+        }
+        if len(data) < totalLength {
+            // Format needs more bytes than the game sent, it can never match
+            c.score = math.Inf(-1)
+            continue
+        }
+        c.score += scorePacket(c, telemArray, totalLength, data)
+        c.samples++
+    }
+}
+
+// Best returns the highest scoring candidate and whether enough datagrams were seen to trust it
+func (d *Detector) Best() (*Candidate, bool) {
+    var best *Candidate
+    for _, c := range d.candidates {
+        if math.IsInf(c.score, -1) || c.samples == 0 {
+            continue
+        }
+        if best == nil || c.score > best.score {
+            best = c
+        }
+    }
+    return best, best != nil && d.samples >= detectSamples
+}
+
+func (d *Detector) logScores() {
+    for _, c := range d.candidates {
+        if c.samples > 0 && !math.IsInf(c.score, -1) {
+            log.Printf("Detection score %s: %.2f", c.Game, c.score/float64(c.samples))
+        }
+    }
+}
+
+// Detect reads datagrams from source until a game can be picked
+func Detect(source util.PacketReader, dir string, debug bool) (*Candidate, error) {
+    d, err := NewDetector(dir)
+    if err != nil {
+        return nil, err
+    }
+
+    util.SetDetecting()
+    log.Println("Detecting game from incoming packets...")
+
+    buffer := make([]byte, 1500)
+    for {
+        n, addr, err := source.ReadFromUDP(buffer)
+        if err != nil {
+            return nil, fmt.Errorf("error reading UDP data: %w", err)
+        }
+        if debug {
+            log.Println("Detection datagram length:", n, addr)
+        }
+
+        util.SetRaw(buffer[:n], nil)
+        d.Add(buffer[:n])
+        if best, ok := d.Best(); ok {
+            if debug {
+                d.logScores()
+            }
+            log.Printf("Detected game: %s (%s)", best.Game, Lookup(best.Game).Describe(best.Game))
+            return best, nil
+        }
+    }
+}
+
+// scorePacket rates how well data fits a candidate format, higher is better
+func scorePacket(c *Candidate, telemArray []util.Telemetry, totalLength int, data []byte) float64 {
+    score := plausibility(telemArray, data)
+
+    if len(data) == totalLength {
+        score += 1
+    }
+    if size, ok := wireSizes[c.Game]; ok && len(data) == size {
+        score += 1
+    }
+
+    return score + signature(c.Game, telemArray, data)
+}
+
+// plausibility is the fraction of numeric fields holding sane values.
+// Reading integers or the wrong offsets as floats gives denormals, NaNs or huge numbers.
+func plausibility(telemArray []util.Telemetry, data []byte) float64 {
+    checked, sane := 0, 0
+    for _, T := range telemArray {
+        chunk := data[T.StartOffset:T.EndOffset]
+        order := T.ByteOrder()
+        var ok bool
+        switch T.DataType {
+        case "f32":
+            ok = saneFloat(float64(util.Float32frombytesOrder(chunk, order)))
+        case "f64":
+            ok = saneFloat(util.Float64frombytesOrder(chunk, order))
+        case "s32":
+            v := int32(order.Uint32(chunk))
+            ok = v > -10000000 && v < 10000000
+        case "u32":
+            ok = order.Uint32(chunk) < 100000000
+        case "bool":
+            ok = chunk[0] <= 1
+        default:
+            continue
+        }
+        checked++
+        if ok {
+            sane++
+        }
+    }
+
+    if checked == 0 {
+        return 0
+    }
+    return float64(sane) / float64(checked)
+}
+
+func saneFloat(v float64) bool {
+    if math.IsNaN(v) || math.IsInf(v, 0) {
+        return false
+    }
+    abs := math.Abs(v)
+    return abs == 0 || (abs > 1e-4 && abs < 1e7)
+}
+
+// signature checks the fields a game is known to fill in a specific way
+func signature(game string, telemArray []util.Telemetry, data []byte) float64 {
+    fields := make(map[string]util.Telemetry)
+    for _, T := range telemArray {
+        fields[T.Name] = T
+    }
+
+    score := 0.0
+
+    // AC RTCarInfo starts with an 'a' identifier
+    if T, ok := fields["Identifier"]; ok && T.DataType == "u8" {
+        if data[T.StartOffset] == 'a' {
+            score += 2
+        } else {
+            score -= 2
+        }
+    }
+
+    // Forza starts with IsRaceOn, only ever 0 or 1
+    if strings.HasPrefix(game, "FM") || strings.HasPrefix(game, "FH") {
+        if T, ok := fields["IsRaceOn"]; ok && T.DataType == "s32" {
+            if v := T.ByteOrder().Uint32(data[T.StartOffset:T.EndOffset]); v <= 1 {
+                score += 0.5
+            } else {
+                score -= 2
+            }
+        }
+    }
+
+    // GT7 packets only decode after decryption, which needs the heartbeat
+    if T, ok := fields["Magic"]; ok && GT7(game) {
+        if v, _ := T.Integer(data); v != gt7Magic {
+            score -= 4
+        }
+    }
+
+    // F1 sends the format year in every header
+    if F1(game) {
+        if T, ok := fields["PacketFormat"]; ok {
+            if v, _ := T.Integer(data); fmt.Sprint(v) == "20"+strings.TrimPrefix(game, "F1") {
+                score += 2
+            } else {
+                score -= 2
+            }
+        }
+    }
+
+    // SMS packets split across datagrams number the parts in every header
+    if PCars(game) {
+        index, okIndex := fields["PartialPacketIndex"]
+        count, okCount := fields["PartialPacketNumber"]
+        if okIndex && okCount {
+            if data[index.StartOffset] <= data[count.StartOffset] {
+                score += 0.5
+            } else {
+                score -= 2
+            }
+        }
+    }
+
+    return score
+}
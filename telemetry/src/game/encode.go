@@ -0,0 +1,79 @@
+package game
+
+import (
+    "math"
+    "strconv"
+    "unicode/utf8"
+)
+
+// JSON of the published values is written by hand into reused buffers,
+// numbers are formatted like encoding/json so dashes read the same output
+
+// appendFloat formats a number like encoding/json, NaN and infinities are null
+func appendFloat(b []byte, f float64, bits int) []byte {
+    if math.IsInf(f, 0) || math.IsNaN(f) {
+        return append(b, "null"...)
+    }
+
+    format := byte('f')
+    if abs := math.Abs(f); abs != 0 {
+        if bits == 64 && (abs < 1e-6 || abs >= 1e21) || bits == 32 && (float32(abs) < 1e-6 || float32(abs) >= 1e21) {
+            format = 'e'
+        }
+    }
+    b = strconv.AppendFloat(b, f, format, -1, bits)
+    if format == 'e' {
+        // e-09 to e-9
+        n := len(b)
+        if n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+            b[n-2] = b[n-1]
+            b = b[:n-1]
+        }
+    }
+    return b
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendString writes a quoted JSON string, invalid UTF-8 becomes U+FFFD
+func appendString(b []byte, s string) []byte {
+    b = append(b, '"')
+    start := 0
+    for i := 0; i < len(s); {
+        c := s[i]
+        if c < utf8.RuneSelf {
+            if c >= 0x20 && c != '"' && c != '\\' {
+                i++
+                continue
+            }
+            b = append(b, s[start:i]...)
+            switch c {
+            case '"', '\\':
+                b = append(b, '\\', c)
+            case '\n':
+                b = append(b, '\\', 'n')
+            case '\r':
+                b = append(b, '\\', 'r')
+            case '\t':
+                b = append(b, '\\', 't')
+            default:
+                b = append(b, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xF])
+            }
+            i++
+            start = i
+            continue
+        }
+
+        r, size := utf8.DecodeRuneInString(s[i:])
+        if r == utf8.RuneError && size == 1 {
+            b = append(b, s[start:i]...)
+            b = append(b, `\ufffd`...)
+            i += size
+            start = i
+            continue
+        }
+        i += size
+    }
+    b = append(b, s[start:]...)
+    return append(b, '"')
+}
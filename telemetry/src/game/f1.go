@@ -0,0 +1,178 @@
+package game
+
+import (
+    "jesseboth/fdt/src/util"
+)
+
+// f1 handles the Codemasters/EA F1 series (2023 and 2024 UDP formats).
+// Every datagram is one packet kind, the shared loop merges them into a
+// single state so the dash sees motion, laps, telemetry and status together.
+type f1 struct {
+    baseGame
+}
+
+func init() {
+    Register(f1{})
+}
+
+const (
+    f1HeaderLength = 29 // bytes of the header shared by every packet
+    f1NumCars      = 22 // cars in every per car array
+)
+
+// Size of one car entry in the per car arrays, by packet format and packet id.
+// Session data is not per car and is left out.
+var f1CarSize = map[uint16]map[int64]int{
+    2023: {0: 60, 2: 50, 6: 60, 7: 55},
+    2024: {0: 60, 2: 57, 6: 60, 7: 55},
+}
+
+// Best lap of the current session, F1 only sends it in the session history packet
+var f1Session uint64
+var f1BestLap float32
+
+// Layout moved to the player car, reused for every packet
+var f1Shifted []util.Telemetry
+
+func (f1) Identify(game string) bool {
+    return F1(game)
+}
+
+func (f1) Describe(game string) string {
+    return F1Game(game)
+}
+
+// Decode reads the player car out of the per car arrays. The format file
+// describes the first car only, its offsets are moved to PlayerCarIndex.
+func (f1) Decode(data []byte, telemArray []util.Telemetry, packet *Packet, debug bool) bool {
+    var packetFormat uint16
+    var packetID int64
+    var player int
+    for _, T := range telemArray {
+        if T.EndOffset > f1HeaderLength {
+            continue
+        }
+        value, _ := T.Integer(data)
+        switch T.Name {
+        case "PacketFormat":
+            packetFormat = uint16(value)
+        case "PacketId":
+            packetID = value
+        case "PlayerCarIndex":
+            player = int(value)
+        }
+    }
+
+    carSize := f1CarSize[packetFormat][packetID]
+    if carSize == 0 || player <= 0 || player >= f1NumCars {
+        DecodePacket(packet, data, telemArray, debug)
+        return true
+    }
+
+    f1Shifted = append(f1Shifted[:0], telemArray...)
+    for i, T := range telemArray {
+        if T.StartOffset >= f1HeaderLength && T.EndOffset <= f1HeaderLength+carSize {
+            f1Shifted[i].StartOffset += player * carSize
+            f1Shifted[i].EndOffset += player * carSize
+        }
+    }
+    DecodePacket(packet, data, f1Shifted, debug)
+    return true
+}
+
+func (f1) PostProcess(game string, packet *Packet, debug bool) bool {
+    packet.SetBool("IsRaceOn", packet.U8("GamePaused") == 0)
+
+    // km/h to m/s like the other games
+    if speed, ok := packet.LookupU16("SpeedKmh"); ok {
+        packet.SetF32("Speed", float32(speed) / 3.6)
+    }
+
+    // Lap times are sent in milliseconds
+    for _, key := range []string{"CurrentLap", "LastLap"} {
+        if ms, ok := packet.LookupU32(key); ok {
+            packet.SetF32(key, float32(ms) / 1000)
+        }
+    }
+
+    if session, ok := packet.LookupU64("SessionUID"); ok && session != f1Session {
+        f1Session = session
+        f1BestLap = 0
+    }
+    if last := packet.F32("LastLap"); last > 0 && (f1BestLap == 0 || last < f1BestLap) {
+        f1BestLap = last
+    }
+    packet.SetF32("BestLap", f1BestLap)
+    packet.SetF32("SessionBestLap", f1BestLap)
+
+    tiresToFahrenheit(packet)
+
+    // Pedals on the 0-255 scale used by Forza
+    if accel, ok := packet.LookupF32("Accel"); ok {
+        packet.SetU8("Accel", uint8(accel * 255))
+    }
+    if brake, ok := packet.LookupF32("Brake"); ok {
+        packet.SetU8("Brake", uint8(brake * 255))
+    }
+    if clutch, ok := packet.LookupU8("Clutch"); ok {
+        packet.SetU8("Clutch", uint8(uint16(clutch) * 255 / 100))
+    }
+
+    if capacity := packet.F32("FuelCapacity"); capacity > 0 {
+        packet.SetF32("Fuel", packet.F32("FuelInTank") / capacity)
+    }
+
+    packet.SetS32("GearNeutral", 0)
+    packet.SetS32("GearReverse", -1)
+
+    return true
+}
+
+func (f1) Fields(game string, decoded []Field) []Field {
+    fields := withFields(decoded, raceOnFields...)
+    fields = withFields(fields,
+        Field{"Speed", "f32", "m/s"},
+        Field{"CurrentLap", "f32", "s"},
+        Field{"LastLap", "f32", "s"},
+        Field{"BestLap", "f32", "s"},
+        Field{"SessionBestLap", "f32", "s"},
+    )
+    for _, key := range tireTemps {
+        fields = withFields(fields, Field{key, "f32", "F"})
+    }
+    return withFields(fields,
+        Field{"Accel", "u8", "0..255"},
+        Field{"Brake", "u8", "0..255"},
+        Field{"Clutch", "u8", "0..255"},
+        Field{"Fuel", "f32", "0..1"},
+    )
+}
+
+func (f1) Mapping(game string) Mapping {
+    return baseMapping.With(Mapping{
+        "steer":    {Key: "Steer"},
+        "lap":      {Key: "LapNumber"},
+        "distance": {Key: "TotalDistance"},
+    })
+}
+
+func F1(game string) bool {
+    switch game {
+        case "F123":
+        case "F124":
+        default:
+            return false
+        }
+    return true
+}
+
+func F1Game(game string) string {
+    switch game {
+        case "F123":
+            return "F1 23"
+        case "F124":
+            return "F1 24"
+        default:
+            return "Unknown"
+        }
+}
@@ -0,0 +1,170 @@
+package game
+
+import (
+    "math"
+    "strconv"
+    "strings"
+
+    "jesseboth/fdt/src/util"
+)
+
+// Field is one value of the telemetry JSON
+type Field struct {
+    Name string `json:"name"`
+    Type string `json:"type"` // packet data type (s32, f32, ...), str, object or array
+    Unit string `json:"unit,omitempty"`
+}
+
+// GameSchema describes the telemetry of a game before its first packet
+// arrives, /telemetry sends the values in the order of Fields
+type GameSchema struct {
+    Game       string        `json:"game"`
+    Name       string        `json:"name"`
+    Fields     []Field       `json:"fields"`
+    Normalized []SchemaField `json:"normalized"` // fields of the Normalized object
+}
+
+// Values most games add in PostProcess, games that only add IsRaceOn use the first
+var raceOnFields = []Field{
+    {"IsRaceOn", "bool", ""},
+    {"GearNeutral", "s32", ""},
+    {"GearReverse", "s32", ""},
+}
+
+// Values updateTiming adds
+var timingFields = []Field{
+    {"Split", "f32", "s"},
+    {"Odometer", "f32", "m"},
+    {"BestLap", "f32", "s"},
+}
+
+// NewGameSchema lists the values the game publishes in order: the fields of
+// the packet format, values its transforms add, values the game computes and
+// the Normalized object
+func NewGameSchema(game string, format *util.Format, detected bool) GameSchema {
+    g := Lookup(game)
+
+    var fields []Field
+    for _, T := range format.AllFields() {
+        if T.Type != util.TypeNone {
+            fields = withFields(fields, Field{Name: T.Name, Type: dataType(T)})
+        }
+    }
+    for _, transform := range format.Transforms {
+        if transform.Kind == "enum" {
+            fields = withFields(fields, Field{Name: transform.Name, Type: "str"})
+        } else {
+            fields = withFields(fields, Field{Name: transform.Name, Type: "f32", Unit: transform.Unit})
+        }
+    }
+
+    fields = g.Fields(game, fields)
+    mappingUnits(fields, g.Mapping(game))
+
+    if detected {
+        fields = append(fields, Field{Name: "DetectedGame", Type: "str"})
+    }
+    fields = append(fields, Field{Name: "Normalized", Type: "object"})
+
+    return GameSchema{Game: game, Name: g.Describe(game), Fields: fields, Normalized: Schema}
+}
+
+// withFields replaces the fields with the same name as a computed one in
+// place, keeping their unit if the computed one has none, and appends the
+// others. fields is modified.
+func withFields(fields []Field, computed ...Field) []Field {
+    for _, field := range computed {
+        i := fieldIndex(fields, field.Name)
+        if i < 0 {
+            fields = append(fields, field)
+            continue
+        }
+        if field.Unit == "" {
+            field.Unit = fields[i].Unit
+        }
+        fields[i] = field
+    }
+    return fields
+}
+
+func fieldIndex(fields []Field, name string) int {
+    for i, field := range fields {
+        if field.Name == name {
+            return i
+        }
+    }
+    return -1
+}
+
+// dataType names the type of a decoded field, strings of any length are str
+func dataType(T util.Telemetry) string {
+    if T.Type == util.TypeString {
+        return "str"
+    }
+    return T.DataType
+}
+
+// mappingUnits fills in the unit of the values the normalized schema reads,
+// the mapping's conversion tells which unit the game sends
+func mappingUnits(fields []Field, mapping Mapping) {
+    for _, schema := range Schema {
+        source, ok := mapping[schema.Name]
+        if !ok {
+            continue
+        }
+        unit := sourceUnit(schema.Unit, source)
+        if unit == "" {
+            continue
+        }
+
+        keys := []string{source.Key}
+        if schema.Type == "f32[4]" {
+            keys = wheelNames(source.Key)
+        }
+        for _, key := range keys {
+            if i := fieldIndex(fields, key); i >= 0 && fields[i].Unit == "" {
+                fields[i].Unit = unit
+            }
+        }
+    }
+}
+
+// sourceUnit returns the unit of a game value converted to unit by s, empty when it is not known
+func sourceUnit(unit string, s Source) string {
+    scale := s.Scale
+    if scale == 0 {
+        scale = 1
+    }
+    if unit == "" || scale == 1 && s.Offset == 0 {
+        return unit
+    }
+
+    // ranges like 0..1 are scaled back, ie: 0..255 for pedals
+    if low, high, ok := strings.Cut(unit, ".."); ok {
+        a, errLow := strconv.ParseFloat(low, 64)
+        b, errHigh := strconv.ParseFloat(high, 64)
+        if errLow != nil || errHigh != nil {
+            return ""
+        }
+        return unitNumber((a-s.Offset)/scale) + ".." + unitNumber((b-s.Offset)/scale)
+    }
+
+    to, ok := util.Units[unit]
+    if !ok {
+        return ""
+    }
+    for name, from := range util.Units {
+        if from.Dimension == to.Dimension && nearly(from.Scale/to.Scale, scale) && nearly((from.Offset-to.Offset)/to.Scale, s.Offset) {
+            return name
+        }
+    }
+    return ""
+}
+
+func unitNumber(f float64) string {
+    return strconv.FormatFloat(math.Round(f*1e6)/1e6, 'f', -1, 64)
+}
+
+func nearly(a, b float64) bool {
+    return math.Abs(a-b) <= 1e-9*math.Max(1, math.Abs(b))
+}
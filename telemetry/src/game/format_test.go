@@ -0,0 +1,231 @@
+package game_test
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/json"
+    "math"
+    "os"
+    "path/filepath"
+    "strconv"
+    "testing"
+
+    "jesseboth/fdt/src/game"
+    "jesseboth/fdt/src/sim"
+    "jesseboth/fdt/src/util"
+)
+
+// testFormat loads a packet format file written by the test
+func testFormat(t *testing.T, text string) *util.Format {
+    t.Helper()
+    file := filepath.Join(t.TempDir(), "TEST_packetformat.dat")
+    if err := os.WriteFile(file, []byte(text), 0644); err != nil {
+        t.Fatal(err)
+    }
+    format, err := util.LoadFormat(file, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return format
+}
+
+// publish hands the datagrams to a generic decoder and returns the values it published last
+func publish(t *testing.T, format *util.Format, datagrams ...[]byte) map[string]interface{} {
+    t.Helper()
+    decoder := game.NewDecoder("TEST", format)
+    for _, data := range datagrams {
+        decoder.Handle(data)
+    }
+    if decoder.JSON() == nil {
+        t.Fatal("nothing was published")
+    }
+
+    var values map[string]interface{}
+    d := json.NewDecoder(bytes.NewReader(decoder.JSON()))
+    d.UseNumber()
+    if err := d.Decode(&values); err != nil {
+        t.Fatalf("published invalid JSON %s: %v", decoder.JSON(), err)
+    }
+    return values
+}
+
+// checkValues compares published numbers against the expected values
+func checkValues(t *testing.T, published map[string]interface{}, want map[string]float64) {
+    t.Helper()
+    for name, value := range want {
+        number, ok := published[name].(json.Number)
+        if !ok {
+            t.Errorf("%s published as %v, want %v", name, published[name], value)
+            continue
+        }
+        got, err := strconv.ParseFloat(string(number), 64)
+        // values are published as f32
+        if err != nil || math.Abs(got-value) > 1e-6*math.Max(1, math.Abs(value)) {
+            t.Errorf("%s published as %s, want %v", name, number, value)
+        }
+    }
+}
+
+// field returns the named field of a layout
+func field(t *testing.T, fields []util.Telemetry, name string) util.Telemetry {
+    t.Helper()
+    for _, T := range fields {
+        if T.Name == name {
+            return T
+        }
+    }
+    t.Fatalf("no field %s", name)
+    return util.Telemetry{}
+}
+
+func TestFormatOffsetsAndArrays(t *testing.T) {
+    format := testFormat(t, `
+s32 Before;
+@0x20 f32 Speed;
+pad 4;
+f32[3] Temp;
+@64;
+u8[FL,FR] Wear;
+`)
+
+    offsets := map[string]int{
+        "Before": 0, "Speed": 0x20, "Temp0": 0x28, "Temp1": 0x2C, "Temp2": 0x30, "WearFL": 64, "WearFR": 65,
+    }
+    for name, offset := range offsets {
+        if T := field(t, format.Fields, name); T.StartOffset != offset {
+            t.Errorf("%s at offset %d, want %d", name, T.StartOffset, offset)
+        }
+    }
+    if len(format.Fields) != len(offsets) || format.Length != 66 {
+        t.Errorf("%d fields in %d bytes, want %d fields in 66 bytes", len(format.Fields), format.Length, len(offsets))
+    }
+
+    values := map[string]float64{
+        "Before": -7, "Speed": 41.5, "Temp0": 80.25, "Temp1": -3.5, "Temp2": 1000, "WearFL": 12, "WearFR": 250,
+    }
+    packets := sim.Packets(values, format)
+    if len(packets) != 1 || len(packets[0]) != 66 {
+        t.Fatalf("encoded %d packets, want one of 66 bytes", len(packets))
+    }
+    if speed := math.Float32frombits(binary.LittleEndian.Uint32(packets[0][0x20:])); speed != 41.5 {
+        t.Errorf("Speed encoded as %v at 0x20, want 41.5", speed)
+    }
+
+    checkValues(t, publish(t, format, packets[0]), values)
+}
+
+func TestFormatEndianness(t *testing.T) {
+    format := testFormat(t, `
+endian big;
+u16 Rpm;
+s32 Position;
+f32 Speed;
+endian little;
+u16 Gear;
+f32be Boost;
+s32le Yaw;
+`)
+
+    values := map[string]float64{
+        "Rpm": 0x1234, "Position": -2, "Speed": 41.5, "Gear": 0x0102, "Boost": 1.25, "Yaw": -300,
+    }
+    packets := sim.Packets(values, format)
+    if len(packets) != 1 {
+        t.Fatalf("encoded %d packets, want one", len(packets))
+    }
+    data := packets[0]
+
+    raw := []struct {
+        name  string
+        order binary.ByteOrder
+        bytes []byte
+    }{
+        {"Rpm", binary.BigEndian, []byte{0x12, 0x34}},
+        {"Position", binary.BigEndian, []byte{0xFF, 0xFF, 0xFF, 0xFE}},
+        {"Speed", binary.BigEndian, []byte{0x42, 0x26, 0x00, 0x00}},
+        {"Gear", binary.LittleEndian, []byte{0x02, 0x01}},
+        {"Boost", binary.BigEndian, []byte{0x3F, 0xA0, 0x00, 0x00}},
+        {"Yaw", binary.LittleEndian, []byte{0xD4, 0xFE, 0xFF, 0xFF}},
+    }
+    for _, r := range raw {
+        T := field(t, format.Fields, r.name)
+        if T.ByteOrder() != r.order {
+            t.Errorf("%s read as %v, want %v", r.name, T.ByteOrder(), r.order)
+        }
+        if got := data[T.StartOffset:T.EndOffset]; !bytes.Equal(got, r.bytes) {
+            t.Errorf("%s encoded as % X, want % X", r.name, got, r.bytes)
+        }
+    }
+
+    checkValues(t, publish(t, format, data), values)
+}
+
+func TestFormatPacketKinds(t *testing.T) {
+    format := testFormat(t, `
+u8 PacketId;
+f32 Time;
+key PacketId;
+packet 0 Motion;
+f32 Speed;
+packet 1 Lap;
+pad 2;
+u16 LapNumber;
+`)
+
+    values := map[string]float64{"Time": 12.5, "Speed": 41.5, "LapNumber": 3}
+    packets := sim.Packets(values, format)
+    if len(packets) != 2 || len(packets[0]) != 9 || len(packets[1]) != 9 {
+        t.Fatalf("encoded %d packets, want two of 9 bytes", len(packets))
+    }
+    if T := field(t, format.Kinds[1].Fields, "LapNumber"); T.StartOffset != 7 {
+        t.Errorf("LapNumber at offset %d, want 7 after the header", T.StartOffset)
+    }
+
+    // the lap packet is published with the speed of the motion packet before it
+    checkValues(t, publish(t, format, packets...), map[string]float64{"PacketId": 1, "Time": 12.5, "Speed": 41.5, "LapNumber": 3})
+
+    decoder := game.NewDecoder("TEST", format)
+    decoder.Handle(packets[0])
+    published := string(decoder.JSON())
+    unknown := append([]byte(nil), packets[0]...)
+    unknown[0] = 7
+    decoder.Handle(unknown)
+    if string(decoder.JSON()) != published {
+        t.Errorf("unknown packet kind published %s", decoder.JSON())
+    }
+}
+
+func TestFormatPacketLength(t *testing.T) {
+    format := testFormat(t, `
+key length;
+packet 8 Short;
+f32 Speed;
+f32 Rpm;
+packet 12 Long;
+f32 Speed;
+f32 Rpm;
+f32 Boost;
+`)
+
+    values := map[string]float64{"Speed": 41.5, "Rpm": 6500, "Boost": 1.25}
+    packets := sim.Packets(values, format)
+    if len(packets) != 2 || len(packets[0]) != 8 || len(packets[1]) != 12 {
+        t.Fatalf("encoded %d packets, want 8 and 12 bytes", len(packets))
+    }
+
+    short := publish(t, format, packets[0])
+    checkValues(t, short, map[string]float64{"Speed": 41.5, "Rpm": 6500})
+    if _, ok := short["Boost"]; ok {
+        t.Error("short packet published Boost")
+    }
+    checkValues(t, publish(t, format, packets[1]), map[string]float64{"Speed": 41.5, "Rpm": 6500, "Boost": 1.25})
+
+    // trailing bytes the format does not describe select the longest kind that fits
+    padded := append(append([]byte(nil), packets[0]...), 0, 0)
+    if _, totalLength, ok := format.Layout(padded); !ok || totalLength != 8 {
+        t.Errorf("10 byte packet read as %d bytes (%v), want the 8 byte kind", totalLength, ok)
+    }
+    if _, _, ok := format.Layout(packets[0][:6]); ok {
+        t.Error("6 byte packet has a layout")
+    }
+}
@@ -1,16 +1,15 @@
 package game
 
 import (
-    "encoding/binary"
     "encoding/json"
     "io/ioutil"
     "log"
     "fmt"
     "math"
-    "net"
     "os"
     "path/filepath"
     "strconv"
+    "sync/atomic"
 
     "jesseboth/fdt/src/util"
 )
@@ -29,6 +28,7 @@ type TimingData struct {
     BestCarTrack  CarDescription       // Track number for the best car for the specific track
     BestCarTrackSplits []float32 // Time for the best car for the specific track
     startMeters   float32
+    unsaved       bool // BestSplits could not be stored
 }
 
 type Odometer struct {
@@ -73,14 +73,24 @@ var odometer = Odometer{
 
 const splitDistance float32 = 12.0  // Distance per split, adjust as necessary
 const maxFloat = 9999999999.0
-var splitType SplitType = Unknown;
+var splitType int32 = int32(Unknown) // SplitType, /control changes it while the loop runs
 var motorsport bool = false;
 
-func ForzaLoop(game string, conn *net.UDPConn, telemArray []util.Telemetry, totalLength int, debug bool) {
-    log.Println("Starting Telemetry:", ForzaGame(game))
-    for {
-        ForzaReadData(conn, telemArray, totalLength, debug)
-    }
+// forza handles Forza Motorsport and Forza Horizon
+type forza struct {
+    baseGame
+}
+
+func init() {
+    Register(forza{})
+}
+
+func (forza) Identify(game string) bool {
+    return Forza(game)
+}
+
+func (forza) Describe(game string) string {
+    return ForzaGame(game)
 }
 
 func Forza(game string) bool {
@@ -90,7 +100,9 @@ func Forza(game string) bool {
         case "FM7":
             setMotorport(true)
         case "FH5":
+            setMotorport(false)
         case "FH4":
+            setMotorport(false)
         default:
             return false
         
@@ -116,174 +128,108 @@ func ForzaGame(game string) string {
     return gameSTR;
 }
 
-func ForzaSetSplit(split string) {
+func ForzaSetSplit(split string) error {
+    var value SplitType
     if split == "car" {
-        splitType = CarSpecific
+        value = CarSpecific
     }else if split == "class" {
-        splitType = ClassSpecific
+        value = ClassSpecific
     }else if split == "session" {
-        splitType = Session
+        value = Session
    }else {
-        fmt.Errorf("Invalid split type %s", split)
-        return
+        return fmt.Errorf("invalid split type %s", split)
     }
+    atomic.StoreInt32(&splitType, int32(value))
+    return nil
 }
 
-func ForzaReadData(conn *net.UDPConn, telemArray []util.Telemetry, totalLength int, debug bool) {
-    buffer := make([]byte, 1500)
-
-    n, addr, err := conn.ReadFromUDP(buffer)
-    if err != nil {
-        log.Fatal("Error reading UDP data:", err, addr)
-    } else if n < totalLength {
-        if(util.WrongData <= 5) {
-            util.WrongData++;
-        } else {
-            util.SetJson("")
-        }
-        return
-    }
-
-    util.WrongData = 0;
-    if debug {
-        log.Println("UDP client connected:", addr)
-    }
-
-    s32map := make(map[string]uint32)
-    u32map := make(map[string]uint32)
-    f32map := make(map[string]float32)
-    u16map := make(map[string]uint16)
-    u8map := make(map[string]uint8)
-    s8map := make(map[string]int8)
-
-    for i, T := range telemArray {
-        data := buffer[:n][T.StartOffset:T.EndOffset]
-
-        if debug {
-            log.Printf("Data chunk %d: %v (%s) (%s)", i, data, T.Name, T.DataType)
-        }
-
-        switch T.DataType {
-        case "s32":
-            s32map[T.Name] = binary.LittleEndian.Uint32(data)
-        case "u32":
-            u32map[T.Name] = binary.LittleEndian.Uint32(data)
-        case "f32":
-            dataFloated := util.Float32frombytes(data)
-            f32map[T.Name] = dataFloated
-        case "u16":
-            u16map[T.Name] = binary.LittleEndian.Uint16(data)
-        case "u8":
-            u8map[T.Name] = uint8(data[0])
-        case "s8":
-            s8map[T.Name] = int8(data[0])
-        }
-    }
+func currentSplitType() SplitType {
+    return SplitType(atomic.LoadInt32(&splitType))
+}
 
+func (forza) PostProcess(game string, packet *Packet, debug bool) bool {
     // Dont print / log / do anything if RPM is zero
     // This happens if the game is paused or you rewind
     // There is a bug with FH4 where it will continue to send data when in certain menus
-    if !motorsport && f32map["CurrentEngineRpm"] == 0 {
-        return
+    if !motorsport && packet.F32("CurrentEngineRpm") == 0 {
+        return false
     }
 
     if debug {
-        log.Printf("RPM: %.0f \t Gear: %d \t BHP: %.0f \t Speed: %.0f \t Total slip: %.0f \t Attitude: %s", f32map["CurrentEngineRpm"], u8map["Gear"], (f32map["Power"] / 745.7), (f32map["Speed"] * 2.237))
-        log.Printf("DistanceTraveled: %.0f", f32map["DistanceTraveled"])
+        log.Printf("RPM: %.0f \t Gear: %d \t BHP: %.0f \t Speed: %.0f", packet.F32("CurrentEngineRpm"), packet.U8("Gear"), (packet.F32("Power") / 745.7), (packet.F32("Speed") * 2.237))
+        log.Printf("DistanceTraveled: %.0f", packet.F32("DistanceTraveled"))
     }
 
-    if timingData.Car.CarNumber != int(s32map["CarOrdinal"]) || timingData.Car.CarClass != int(s32map["CarClass"]) {
+    if timingData.Car.CarNumber != int(packet.S32("CarOrdinal")) || timingData.Car.CarClass != int(packet.S32("CarClass")) {
         // Update CarNumber and CarClass
-        timingData.Car.CarNumber = int(s32map["CarOrdinal"])
-        timingData.Car.CarClass = int(s32map["CarClass"])
+        timingData.Car.CarNumber = int(packet.S32("CarOrdinal"))
+        timingData.Car.CarClass = int(packet.S32("CarClass"))
 
         // Check if the game is "FM" and TrackOrdinal exists
-        if motorsport && checkKeyExists(s32map, "TrackOrdinal") {
-            timingData.Car.TrackNumber = int(s32map["TrackOrdinal"])
+        if motorsport && packet.Has("TrackOrdinal") {
+            timingData.Car.TrackNumber = int(packet.S32("TrackOrdinal"))
             } else {
                 timingData.Car.TrackNumber = -1 // Set default value if TrackOrdinal is not found
             }
-        timingData.BestSplits, err = getTimingSplits(timingData.Car)
-        timingData.BestCarTrack, timingData.BestCarTrackSplits, err = getBestCarforTrack(timingData.Car)
-    } else if trackOrdinal, ok := s32map["TrackOrdinal"]; ok {
+        timingData.BestSplits, _ = getTimingSplits(timingData.Car)
+        timingData.BestCarTrack, timingData.BestCarTrackSplits, _ = getBestCarforTrack(timingData.Car)
+    } else if trackOrdinal, ok := packet.LookupS32("TrackOrdinal"); ok {
         // Check if TrackOrdinal exists and is different from current TrackNumber
         if timingData.Car.TrackNumber != int(trackOrdinal) {
             // Update Car properties
-            timingData.Car.CarNumber = int(s32map["CarOrdinal"])
-            timingData.Car.CarClass = int(s32map["CarClass"])
+            timingData.Car.CarNumber = int(packet.S32("CarOrdinal"))
+            timingData.Car.CarClass = int(packet.S32("CarClass"))
             timingData.Car.TrackNumber = int(trackOrdinal)
-            timingData.BestSplits, err = getTimingSplits(timingData.Car)
-            timingData.BestCarTrack, timingData.BestCarTrackSplits, err = getBestCarforTrack(timingData.Car)
+            timingData.BestSplits, _ = getTimingSplits(timingData.Car)
+            timingData.BestCarTrack, timingData.BestCarTrackSplits, _ = getBestCarforTrack(timingData.Car)
         }
     }
 
-    if isRaceOn, ok := s32map["IsRaceOn"]; ok && isRaceOn == 1  {
-        f32map["Split"] = updateSplit(&timingData, f32map["DistanceTraveled"], u16map["LapNumber"], f32map["CurrentLap"], f32map["LastLap"], f32map["SessionBestLap"]);
-        f32map["Odometer"] = updateOdometer(f32map["DistanceTraveled"], s32map["CarOrdinal"], f32map["Speed"]);
+    isRaceOn, ok := packet.LookupS32("IsRaceOn")
+    updateTiming(packet, packet.U16("LapNumber"), uint32(packet.S32("CarOrdinal")), ok && isRaceOn == 1)
+
+    return true
+}
+
+func (forza) Fields(game string, decoded []Field) []Field {
+    return withFields(decoded, timingFields...)
+}
+
+// updateTiming adds Split, Odometer and BestLap from the distance traveled,
+// lap is counted from 0 and carNumber keys the stored odometer
+func updateTiming(packet *Packet, lap uint16, carNumber uint32, raceOn bool) {
+    if raceOn {
+        packet.SetF32("Split", updateSplit(&timingData, packet.F32("DistanceTraveled"), lap, packet.F32("CurrentLap"), packet.F32("LastLap"), packet.F32("SessionBestLap")));
+        packet.SetF32("Odometer", updateOdometer(packet.F32("DistanceTraveled"), carNumber, packet.F32("Speed")));
 
         // Set best Lap
+        splitType := currentSplitType()
         if(splitType == CarSpecific && len(timingData.BestSplits) > 0) {
-            f32map["BestLap"] = lastVal(timingData.BestSplits);
+            packet.SetF32("BestLap", lastVal(timingData.BestSplits));
         } else if(splitType == ClassSpecific && len(timingData.BestCarTrackSplits) > 0) {
-            f32map["BestLap"] = lastVal(timingData.BestCarTrackSplits);
+            packet.SetF32("BestLap", lastVal(timingData.BestCarTrackSplits));
         } else if(splitType == Session && len(timingData.SessionSplits) > 0) {
-            f32map["BestLap"] = lastVal(timingData.SessionSplits);
+            packet.SetF32("BestLap", lastVal(timingData.SessionSplits));
         } else {
-            f32map["BestLap"] = 0;
+            packet.SetF32("BestLap", 0);
         }
     }else {
 
-        // Set odometer and reset car number
-        setOdometer(odometer);
-        odometer.carNumber = 0;
-
-        f32map["Split"] = maxFloat;
-        f32map["BestLap"] = 0;
-        f32map["Odometer"] = 0;
-    }
-
-    if true {
-        // Create a single map to hold all combined data
-        combinedMap := make(map[string]interface{})
-
-        // Add each original map's contents to the combined map
-        for k, v := range s32map {
-            combinedMap[k] = v
-        }
-        for k, v := range u32map {
-            combinedMap[k] = v
-        }
-        for k, v := range f32map {
-            combinedMap[k] = v
-        }
-        for k, v := range u16map {
-            combinedMap[k] = v
-        }
-        for k, v := range u8map {
-            combinedMap[k] = v
-        }
-        for k, v := range s8map {
-            combinedMap[k] = v
-        }
-
-        // Marshal the combined map into a single JSON object
-        finalJSON, err := json.Marshal(combinedMap)
-        if err != nil {
-            log.Fatalf("Error marshalling combined JSON: %v", err)
+        // Set odometer and reset car number, once when the race stops
+        if odometer.carNumber > 0 {
+            setOdometer(odometer);
+            odometer.carNumber = 0;
         }
 
-        util.SetJson(fmt.Sprintf("%s", finalJSON))
+        packet.SetF32("Split", maxFloat);
+        packet.SetF32("BestLap", 0);
+        packet.SetF32("Odometer", 0);
     }
 }
 
-func checkKeyExists[K comparable, V any](m map[K]V, key K) bool {
-    _, exists := m[key]
-    return exists
-}
-
 func setTimingSplits(data TimingData) error {
     if(!motorsport || data.Car.TrackNumber == -1) {
-        fmt.Errorf("Storing splits not allowed for game")
+        // Storing splits not allowed for game
         return nil
     }
 
@@ -391,6 +337,7 @@ func updateSplit(timingData *TimingData, distance float32, lap uint16, time floa
                         if err != nil {
                             log.Println("Error storing timing data:", err)
                         }
+                        timingData.unsaved = err != nil
                     }
 
                     if last < lastVal(timingData.BestCarTrackSplits) {
@@ -439,6 +386,7 @@ func updateSplit(timingData *TimingData, distance float32, lap uint16, time floa
 
     bestIndex := index
     var targetSplits []float32
+    splitType := currentSplitType()
     if(motorsport && splitType == ClassSpecific) {
         targetSplits = timingData.BestCarTrackSplits
     } else if motorsport && splitType == CarSpecific {
@@ -505,8 +453,6 @@ func updateOdometer(distance float32, carNumber uint32, velocity float32) float3
     } else {
         return odometer.Odometer + odometer.distance - odometer.offset;
     }
-
-    return 0;
 }
 
 // ReadTopInt reads the first line of a file, trims any whitespace, and converts it to an integer.
@@ -522,7 +468,7 @@ func getBestCarforTrack(car CarDescription) (CarDescription, []float32, error) {
 
     line, err := util.ReadFileTop(filePath)
     if err != nil {
-        return trackCar, []float32{}, fmt.Errorf("error reading file: ", err)
+        return trackCar, []float32{}, fmt.Errorf("error reading file: %w", err)
     }
 
     value, err := strconv.Atoi(line)
@@ -538,7 +484,7 @@ func getBestCarforTrack(car CarDescription) (CarDescription, []float32, error) {
 
     splits, err := getTimingSplits(trackCar)
     if len(splits) == 0 {
-        return trackCar, []float32{}, fmt.Errorf("error reading file: ", err)
+        return trackCar, []float32{}, fmt.Errorf("error reading file: %w", err)
     }
         
     return trackCar, splits, nil
@@ -595,6 +541,30 @@ func setOdometer(odo Odometer) error {
     return nil
 }
 
+// Flush stores the odometer, which is otherwise only written when the car
+// changes or leaves the track, and best splits that could not be stored.
+// The lap state is forgotten so the next game starts afresh.
+func Flush() {
+    if odometer.carNumber > 0 {
+        if err := setOdometer(odometer); err != nil {
+            log.Println("Error storing odometer:", err)
+        }
+        odometer.carNumber = 0
+    }
+
+    if timingData.unsaved {
+        pending := timingData
+        pending.TimingSplits = timingData.BestSplits
+        if err := setTimingSplits(pending); err != nil {
+            log.Println("Error storing timing data:", err)
+        } else {
+            timingData.unsaved = false
+        }
+    }
+
+    resetLaps()
+}
+
 func lastVal(arr []float32) float32 {
     if len(arr) == 0 {
         return 3.402823466e+38 // Max value for float32
@@ -604,4 +574,22 @@ func lastVal(arr []float32) float32 {
 
 func setMotorport(value bool) {
     motorsport = value
+}
+
+// selectTiming prepares the timing state for the game about to be decoded,
+// best splits are only stored for games raced on circuits. Lap state left
+// by the last game is forgotten.
+func selectTiming(game string) {
+    resetLaps()
+    if Forza(game) {
+        // Forza tells Motorsport from Horizon itself
+        return
+    }
+    setMotorport(GT7(game) || PCars(game))
+}
+
+// resetLaps forgets the lap state games keep between packets
+func resetLaps() {
+    gt7Reset()
+    pcarsReset()
 }
\ No newline at end of file
@@ -0,0 +1,255 @@
+package game
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "log"
+    "sync/atomic"
+
+    "jesseboth/fdt/src/util"
+)
+
+// Game is implemented by every supported title. The shared loop reads the
+// datagram, asks the game to decode it and post-process the result, then
+// publishes the combined JSON.
+type Game interface {
+    // Identify reports whether the abbreviated game id (FM, DR2, ...) belongs to this game
+    Identify(game string) bool
+
+    // Describe returns a human readable name for the game id
+    Describe(game string) string
+
+    // Decode unpacks a datagram according to the packet format into packet,
+    // an empty packet reused for every datagram. false skips the datagram.
+    Decode(data []byte, telemArray []util.Telemetry, packet *Packet, debug bool) bool
+
+    // PostProcess adds computed fields, returning false to drop the packet
+    PostProcess(game string, packet *Packet, debug bool) bool
+
+    // Mapping tells how the post processed values map to the normalized Schema
+    Mapping(game string) Mapping
+
+    // Fields returns the values PostProcess publishes given the decoded ones,
+    // in the order they are published
+    Fields(game string, decoded []Field) []Field
+}
+
+var registry []Game
+var fallback Game = defaultGame{}
+
+// debugging turns on logging every datagram, /control toggles it while the loop runs
+var debugging int32
+
+// SetDebug turns debug logging on or off, the running loop follows it from the next datagram
+func SetDebug(debug bool) {
+    var value int32
+    if debug {
+        value = 1
+    }
+    atomic.StoreInt32(&debugging, value)
+}
+
+// Debugging reports whether debug logging is on
+func Debugging() bool {
+    return atomic.LoadInt32(&debugging) != 0
+}
+
+// Register adds a game to the registry, games are matched in registration order
+func Register(g Game) {
+    registry = append(registry, g)
+}
+
+// Lookup returns the registered game for the id, or the generic decoder if none match
+func Lookup(game string) Game {
+    for _, g := range registry {
+        if g.Identify(game) {
+            return g
+        }
+    }
+    return fallback
+}
+
+// Loop reads and publishes telemetry for the game until the source is
+// exhausted, or closed once ctx is done
+func Loop(ctx context.Context, game string, conn util.PacketReader, format *util.Format) error {
+    d := NewDecoder(game, format)
+    selectTiming(game)
+    log.Println("Starting Telemetry:", d.g.Describe(game))
+    util.SetSchema(d.Schema())
+
+    for {
+        err := readData(d, conn)
+        if ctx.Err() != nil || err == io.EOF {
+            // Only a replayed session runs out of data
+            return nil
+        } else if err != nil {
+            return err
+        }
+    }
+}
+
+// Decoder turns datagrams into published JSON. The format is compiled
+// once into a Layout of typed slots in schema order, packets are decoded
+// into the slots and encoded from them into a reused buffer, so a datagram
+// allocates nothing once every value has been seen.
+type Decoder struct {
+    g        Game
+    game     string
+    format   *util.Format
+    mapping  Mapping
+    schema   GameSchema
+    detected bool
+
+    buffer     []byte
+    packet     *Packet // the datagram being decoded
+    state      *Packet // every value received, multi packet games only send part of it in each datagram
+    post       *Packet // copy of state that is post processed, so computed fields are not applied twice
+    normalized *Normalized
+    json       []byte
+}
+
+// NewDecoder prepares decoding the game's datagrams with format
+func NewDecoder(game string, format *util.Format) *Decoder {
+    g := Lookup(game)
+    d := &Decoder{
+        g:        g,
+        game:     game,
+        format:   format,
+        mapping:  g.Mapping(game),
+        detected: util.GetStatus().Detected,
+        buffer:   make([]byte, 1500),
+    }
+    d.schema = NewGameSchema(game, format, d.detected)
+    d.normalized = NewNormalized(d.mapping)
+
+    layout := NewLayout(format, d.schema.Fields)
+    d.packet = NewPacket(layout)
+    if format.Multi() {
+        d.state = NewPacket(layout)
+        d.post = NewPacket(layout)
+    }
+    return d
+}
+
+// Schema returns the values the decoder publishes, in the order they are sent
+func (d *Decoder) Schema() GameSchema {
+    return d.schema
+}
+
+// JSON returns the last datagram the decoder published, it is only valid
+// until the next datagram is handled
+func (d *Decoder) JSON() []byte {
+    return d.json
+}
+
+func readData(d *Decoder, conn util.PacketReader) error {
+    n, addr, err := conn.ReadFromUDP(d.buffer)
+
+    debug := Debugging()
+    if debug {
+        log.Println("Received data length:", n)
+    }
+
+    if err == io.EOF {
+        return err
+    } else if err != nil {
+        return fmt.Errorf("error reading UDP data from %v: %w", addr, err)
+    }
+
+    if debug {
+        log.Println("UDP client connected:", addr)
+    }
+    d.Handle(d.buffer[:n])
+    return nil
+}
+
+// Handle decodes, post processes and publishes one datagram
+func (d *Decoder) Handle(data []byte) {
+    format, debug := d.format, Debugging()
+    util.SetRaw(data, format)
+
+    telemArray, totalLength, ok := format.Layout(data)
+    if !ok {
+        if debug {
+            id, _ := format.KeyValue(data)
+            log.Printf("Skipping unknown packet %s %d", format.Key, id)
+        }
+        return
+    } else if len(data) < totalLength {
+        if util.WrongData <= 5 {
+            util.WrongData++
+        } else {
+            util.SetJson(nil)
+        }
+        return
+    }
+    util.WrongData = 0
+
+    packet := d.packet
+    packet.Reset()
+    if !d.g.Decode(data, telemArray, packet, debug) {
+        return
+    }
+    if d.state != nil {
+        d.state.Merge(packet)
+        packet = d.post
+        packet.Reset()
+        packet.Merge(d.state)
+    }
+    applyTransforms(packet, format.Transforms)
+
+    if !d.g.PostProcess(d.game, packet, debug) {
+        return
+    }
+
+    if d.detected {
+        packet.SetStr("DetectedGame", d.game)
+    }
+    d.normalized.Update(packet)
+    packet.SetObject("Normalized", d.normalized)
+
+    d.json = packet.AppendJSON(d.json[:0])
+    if debug {
+        log.Println(string(d.json))
+    }
+    util.SetJson(d.json)
+}
+
+// baseGame provides the generic decoder, embed it to only override what differs
+type baseGame struct{}
+
+func (baseGame) Decode(data []byte, telemArray []util.Telemetry, packet *Packet, debug bool) bool {
+    DecodePacket(packet, data, telemArray, debug)
+    return true
+}
+
+func (baseGame) PostProcess(game string, packet *Packet, debug bool) bool {
+    return true
+}
+
+func (baseGame) Mapping(game string) Mapping {
+    return baseMapping
+}
+
+func (baseGame) Fields(game string, decoded []Field) []Field {
+    return decoded
+}
+
+// rpmLimit stands in for the rev limit of games that do not send one,
+// it is the highest RPM seen since the car changed
+type rpmLimit struct {
+    car string
+    max float32
+}
+
+func (r *rpmLimit) update(car string, rpm float32) float32 {
+    if car != r.car {
+        r.car = car
+        r.max = 0
+    }
+    if rpm > r.max {
+        r.max = rpm
+    }
+    return r.max
+}
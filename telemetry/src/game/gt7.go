@@ -0,0 +1,392 @@
+package game
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "log"
+    "math"
+    "net"
+    "os"
+    "strconv"
+    "time"
+
+    "jesseboth/fdt/src/util"
+)
+
+const (
+    GT7Port          = 33740 // port the console sends telemetry to
+    GT7HeartbeatPort = 33739 // port the console receives the heartbeat on
+
+    gt7Magic      = 0x47375330 // "0S7G" at the start of every decrypted packet
+    gt7IVOffset   = 0x40       // the nonce is derived from these 4 bytes
+    gt7IVMask     = 0xDEADBEAF
+    gt7PacketSize = 296
+
+    // The console stops sending unless it hears from us every ~100 packets
+    gt7HeartbeatInterval = time.Second
+    gt7HeartbeatPackets  = 100
+)
+
+// Salsa20 key, the first 32 bytes of "Simulator Interface Packet GT7 ver 0.0"
+var gt7Key = func() (key [32]byte) {
+    copy(key[:], "Simulator Interface Packet GT7 ver 0.0")
+    return key
+}()
+
+// gt7 handles Gran Turismo 7
+type gt7 struct {
+    baseGame
+}
+
+func init() {
+    Register(gt7{})
+}
+
+// Lap state, GT7 sends neither the current lap time nor the distance traveled
+var gt7Lap uint16
+var gt7LapStart int32 = -1
+var gt7PrevPacket int32 = -1
+var gt7Distance float32
+var gt7LapDistance float32 // gt7Distance when the lap started
+
+// GT7 sends no track id either, tracks are told apart by where the start
+// line is and how long a lap is. Known tracks are stored one per line in
+// gt7TracksFile, the line is the track number splits are stored under.
+const (
+    gt7TracksFile      = "data/gt7tracks"
+    gt7LineRadius      = 50   // m, start line positions closer than this match
+    gt7LengthTolerance = 0.03 // lap lengths within 3% match
+    gt7MinLap          = 300  // m, shorter laps were not driven through
+)
+
+type gt7Track struct {
+    x, z   float32 // start line position
+    length float32
+}
+
+var gt7Tracks []gt7Track
+var gt7TracksLoaded bool
+var gt7TrackNumber = -1
+
+// gt7Reset forgets the lap and track of the last session
+func gt7Reset() {
+    gt7Lap = 0
+    gt7LapStart = -1
+    gt7PrevPacket = -1
+    gt7Distance = 0
+    gt7LapDistance = 0
+    gt7TrackNumber = -1
+}
+
+func (gt7) Identify(game string) bool {
+    return GT7(game)
+}
+
+func (gt7) Describe(game string) string {
+    return GT7Game(game)
+}
+
+func (gt7) PostProcess(game string, packet *Packet, debug bool) bool {
+    if packet.U32("Magic") != gt7Magic {
+        if debug {
+            log.Printf("Dropping GT7 packet with magic %x", packet.U32("Magic"))
+        }
+        return false
+    }
+
+    flags := packet.U16("Flags")
+    raceOn := flags&0x1 != 0 && flags&0x6 == 0 // on track, not paused or loading
+    packet.SetBool("IsRaceOn", raceOn)
+
+    gears := packet.U8("Gears")
+    packet.SetU8("Gear", gears & 0x0F)
+    packet.SetU8("SuggestedGear", gears >> 4)
+    packet.SetS32("GearNeutral", 15)
+    packet.SetS32("GearReverse", 0)
+
+    gearMax := uint8(0)
+    for i := 0; i < 8; i++ {
+        if packet.F32("GearRatio"+strconv.Itoa(i)) > 0 {
+            gearMax++
+        }
+    }
+    if gearMax > 0 {
+        packet.SetU8("GearMax", gearMax)
+    }
+
+    packet.SetU8("Clutch", uint8(packet.F32("ClutchPedal") * 255))
+    if flags&0x40 != 0 {
+        packet.SetU8("HandBrake", 255)
+    } else {
+        packet.SetU8("HandBrake", 0)
+    }
+
+    if capacity := packet.F32("FuelCapacity"); capacity > 0 {
+        packet.SetF32("Fuel", packet.F32("FuelInTank") / capacity)
+    }
+
+    tiresToFahrenheit(packet)
+
+    // Lap times are sent in milliseconds, -1 when there is none
+    for _, key := range []string{"LastLap", "BestLap"} {
+        ms := packet.S32(key)
+        if ms > 0 {
+            packet.SetF32(key, float32(ms) / 1000)
+        } else {
+            packet.SetF32(key, 0)
+        }
+    }
+    best := packet.F32("BestLap")
+    packet.SetF32("SessionBestLap", best)
+
+    gt7UpdateLap(packet)
+
+    car := CarDescription{CarNumber: int(packet.S32("CarOrdinal")), TrackNumber: gt7TrackNumber, CarClass: -1}
+    if timingData.Car != car {
+        timingData.Car = car
+        timingData.BestSplits, _ = getTimingSplits(car)
+    }
+
+    lap := packet.U16("LapNumber")
+    if lap > 0 {
+        lap--
+    }
+    updateTiming(packet, lap, uint32(packet.S32("CarOrdinal")), raceOn)
+    if raceOn && best > 0 {
+        packet.SetF32("BestLap", best)
+    }
+
+    return true
+}
+
+func (gt7) Fields(game string, decoded []Field) []Field {
+    fields := withFields(decoded, raceOnFields...)
+    fields = withFields(fields,
+        Field{"Gear", "u8", ""},
+        Field{"SuggestedGear", "u8", ""},
+        Field{"GearMax", "u8", ""},
+        Field{"Clutch", "u8", "0..255"},
+        Field{"HandBrake", "u8", "0..255"},
+        Field{"Fuel", "f32", "0..1"},
+    )
+    for _, key := range tireTemps {
+        fields = withFields(fields, Field{key, "f32", "F"})
+    }
+    fields = withFields(fields,
+        Field{"LastLap", "f32", "s"},
+        Field{"BestLap", "f32", "s"},
+        Field{"SessionBestLap", "f32", "s"},
+        Field{"CurrentLap", "f32", "s"},
+        Field{"DistanceTraveled", "f32", "m"},
+    )
+    return withFields(fields, timingFields...)
+}
+
+// gt7UpdateLap derives CurrentLap and DistanceTraveled from the 60Hz packet id
+func gt7UpdateLap(packet *Packet) {
+    id := packet.S32("PacketId")
+    lap := packet.U16("LapNumber")
+
+    dt := float32(0)
+    if gt7PrevPacket >= 0 && id > gt7PrevPacket {
+        dt = float32(id-gt7PrevPacket) / 60
+    }
+    gt7PrevPacket = id
+
+    if lap != gt7Lap || gt7LapStart < 0 || id < gt7LapStart {
+        if lap == 0 || lap < gt7Lap {
+            // Back before the start line or a new race, possibly on another track
+            gt7Distance = 0
+            gt7TrackNumber = -1
+        } else if gt7Lap > 0 && lap == gt7Lap+1 {
+            // A lap was driven through, the car is on the start line
+            length := gt7Distance - gt7LapDistance
+            if length >= gt7MinLap {
+                gt7TrackNumber = gt7FindTrack(packet.F32("PositionX"), packet.F32("PositionZ"), length)
+            }
+        }
+        gt7Lap = lap
+        gt7LapStart = id
+        gt7LapDistance = gt7Distance
+    }
+
+    if lap == 0 {
+        packet.SetF32("CurrentLap", 0)
+        packet.SetF32("DistanceTraveled", -1)
+        return
+    }
+
+    if dt < 1 {
+        gt7Distance += packet.F32("Speed") * dt
+    }
+    packet.SetF32("CurrentLap", float32(id-gt7LapStart) / 60)
+    packet.SetF32("DistanceTraveled", gt7Distance)
+}
+
+// gt7FindTrack returns the number of the track with a start line at x, z and
+// laps of length, a track not seen before is added
+func gt7FindTrack(x float32, z float32, length float32) int {
+    if !gt7TracksLoaded {
+        gt7Tracks = loadGT7Tracks(gt7TracksFile)
+        gt7TracksLoaded = true
+    }
+
+    for i, track := range gt7Tracks {
+        dx, dz := float64(x-track.x), float64(z-track.z)
+        if math.Hypot(dx, dz) < gt7LineRadius && math.Abs(float64(length-track.length)) < gt7LengthTolerance*float64(track.length) {
+            return i
+        }
+    }
+
+    track := gt7Track{x: x, z: z, length: length}
+    if err := util.AppendFile(gt7TracksFile, fmt.Sprintf("%f %f %f\n", track.x, track.z, track.length)); err != nil {
+        log.Println("Error storing GT7 track:", err)
+        return -1
+    }
+    gt7Tracks = append(gt7Tracks, track)
+    log.Printf("New GT7 track %d, %.0fm lap", len(gt7Tracks)-1, length)
+    return len(gt7Tracks) - 1
+}
+
+// loadGT7Tracks reads the known tracks, a line that cannot be read keeps
+// its number but never matches
+func loadGT7Tracks(file string) []gt7Track {
+    lines, err := util.ReadLines(file)
+    if err != nil && !os.IsNotExist(err) {
+        log.Println("Error reading GT7 tracks:", err)
+    }
+    tracks := make([]gt7Track, len(lines))
+    for i, line := range lines {
+        fmt.Sscan(line, &tracks[i].x, &tracks[i].z, &tracks[i].length)
+    }
+    return tracks
+}
+
+// GT7Conn asks a console for telemetry with a periodic heartbeat and
+// decrypts the packets it sends back. Datagrams that do not decrypt to a
+// GT7 packet are dropped.
+type GT7Conn struct {
+    conn     util.UDPConn
+    console  *net.UDPAddr
+    sent     time.Time
+    received int
+}
+
+// NewGT7Conn sends the heartbeat to the console IP from conn, which must be bound to GT7Port
+func NewGT7Conn(conn util.UDPConn, console string) (*GT7Conn, error) {
+    addr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(console, strconv.Itoa(GT7HeartbeatPort)))
+    if err != nil {
+        return nil, err
+    }
+    c := &GT7Conn{
+        conn:    conn,
+        console: addr,
+    }
+    c.heartbeat()
+    return c, nil
+}
+
+func (c *GT7Conn) heartbeat() {
+    if _, err := c.conn.WriteToUDP([]byte("A"), c.console); err != nil {
+        log.Printf("Error sending GT7 heartbeat to %s: %v", c.console, err)
+    } else if Debugging() {
+        log.Printf("GT7 heartbeat sent to %s", c.console)
+    }
+    c.sent = time.Now()
+    c.received = 0
+}
+
+// ReadFromUDP returns the next decrypted GT7 packet
+func (c *GT7Conn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+    for {
+        if c.received >= gt7HeartbeatPackets || time.Since(c.sent) >= gt7HeartbeatInterval {
+            c.heartbeat()
+        }
+
+        // Wake up in time for the next heartbeat when the console is quiet
+        c.conn.SetReadDeadline(c.sent.Add(gt7HeartbeatInterval))
+        n, addr, err := c.conn.ReadFromUDP(b)
+        var netErr net.Error
+        if errors.As(err, &netErr) && netErr.Timeout() {
+            continue
+        } else if err != nil {
+            return n, addr, err
+        }
+
+        c.received++
+        if !GT7Decrypt(b[:n]) {
+            if Debugging() {
+                log.Printf("Dropping %d byte datagram from %s, not a GT7 packet", n, addr)
+            }
+            continue
+        }
+        return n, addr, nil
+    }
+}
+
+// GT7Reader decrypts the packets of a recorded GT7 session, packets that
+// were recorded decrypted are passed through as they are
+type GT7Reader struct {
+    source util.PacketReader
+}
+
+func NewGT7Reader(source util.PacketReader) *GT7Reader {
+    return &GT7Reader{source: source}
+}
+
+// ReadFromUDP returns the next GT7 packet of the session
+func (r *GT7Reader) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+    for {
+        n, addr, err := r.source.ReadFromUDP(b)
+        if err != nil {
+            return n, addr, err
+        }
+        if n >= 4 && binary.LittleEndian.Uint32(b) == gt7Magic || GT7Decrypt(b[:n]) {
+            return n, addr, nil
+        }
+    }
+}
+
+// GT7Decrypt decrypts a packet in place and reports whether it holds the GT7 magic
+func GT7Decrypt(data []byte) bool {
+    if len(data) < gt7PacketSize {
+        return false
+    }
+    util.Salsa20XOR(data, data, gt7Nonce(data), &gt7Key)
+    return binary.LittleEndian.Uint32(data) == gt7Magic
+}
+
+// GT7Encrypt encrypts a packet in place the way the console does, the IV is
+// stored in the packet so GT7Decrypt can recover it
+func GT7Encrypt(data []byte, iv uint32) {
+    binary.LittleEndian.PutUint32(data[gt7IVOffset:], iv)
+    nonce := gt7Nonce(data)
+    util.Salsa20XOR(data, data, nonce, &gt7Key)
+    binary.LittleEndian.PutUint32(data[gt7IVOffset:], iv)
+}
+
+func gt7Nonce(data []byte) []byte {
+    iv := binary.LittleEndian.Uint32(data[gt7IVOffset:])
+    nonce := make([]byte, 8)
+    binary.LittleEndian.PutUint32(nonce, iv^gt7IVMask)
+    binary.LittleEndian.PutUint32(nonce[4:], iv)
+    return nonce
+}
+
+func (gt7) Mapping(game string) Mapping {
+    return baseMapping.With(Mapping{
+        "lap": {Key: "LapNumber"},
+    })
+}
+
+func GT7(game string) bool {
+    return game == "GT7"
+}
+
+func GT7Game(game string) string {
+    if GT7(game) {
+        return "Gran Turismo 7"
+    }
+    return "Unknown"
+}
@@ -0,0 +1,176 @@
+package game_test
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "encoding/hex"
+    "io"
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "jesseboth/fdt/src/game"
+    "jesseboth/fdt/src/sim"
+    "jesseboth/fdt/src/util"
+)
+
+const gt7Magic = 0x47375330
+
+// ECRYPT Salsa20/20 256 bit key set 1 vector 0, the first 64 bytes of the key stream
+func TestSalsa20Vector(t *testing.T) {
+    var key [32]byte
+    key[0] = 0x80
+    want, _ := hex.DecodeString("E3BE8FDD8BECA2E3EA8EF9475B29A6E7003951E1097A5C38D23B7A5FAD9F6844" +
+        "B22C97559E2723C7CBBD3FE4FC8D9A0744652A83E72A9C461876AF4D7EF1A117")
+
+    stream := make([]byte, 64)
+    util.Salsa20XOR(stream, stream, make([]byte, 8), &key)
+    if !bytes.Equal(stream, want) {
+        t.Errorf("key stream %X, want %X", stream, want)
+    }
+}
+
+// gt7Packet returns a plaintext GT7 packet of the simulated car
+func gt7Packet(t *testing.T) []byte {
+    format := loadFormat(t, filepath.Join(formatDir, "GT7_packetformat.dat"))
+    packet := datagrams("GT7", format, 60)[59]
+    if binary.LittleEndian.Uint32(packet) != gt7Magic {
+        t.Fatalf("simulated packet starts with %X, not the GT7 magic", packet[:4])
+    }
+    return packet
+}
+
+// sameExceptIV compares two packets, the IV is not restored by decrypting
+func sameExceptIV(a []byte, b []byte) bool {
+    return len(a) == len(b) && bytes.Equal(a[:0x40], b[:0x40]) && bytes.Equal(a[0x44:], b[0x44:])
+}
+
+func TestGT7Decrypt(t *testing.T) {
+    plain := gt7Packet(t)
+    const iv = 0x01020304
+
+    // encrypted the way the console does: the nonce is the IV xor 0xDEADBEAF followed by the IV
+    var key [32]byte
+    copy(key[:], "Simulator Interface Packet GT7 ver 0.0")
+    nonce := []byte{0x04 ^ 0xAF, 0x03 ^ 0xBE, 0x02 ^ 0xAD, 0x01 ^ 0xDE, 0x04, 0x03, 0x02, 0x01}
+    encrypted := make([]byte, len(plain))
+    util.Salsa20XOR(encrypted, plain, nonce, &key)
+    binary.LittleEndian.PutUint32(encrypted[0x40:], iv)
+
+    data := append([]byte(nil), encrypted...)
+    if !game.GT7Decrypt(data) {
+        t.Fatal("encrypted packet did not decrypt")
+    }
+    if !sameExceptIV(data, plain) {
+        t.Error("decrypted packet differs from the plaintext")
+    }
+
+    data = append([]byte(nil), plain...)
+    game.GT7Encrypt(data, iv)
+    if !bytes.Equal(data, encrypted) {
+        t.Error("GT7Encrypt differs from the console encryption")
+    }
+
+    if game.GT7Decrypt(append([]byte(nil), plain...)) {
+        t.Error("plaintext packet decrypted to the GT7 magic")
+    }
+    if game.GT7Decrypt(append([]byte(nil), encrypted[:200]...)) {
+        t.Error("short packet decrypted")
+    }
+}
+
+func TestGT7Console(t *testing.T) {
+    conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    console, err := sim.NewConsole(conn.LocalAddr().(*net.UDPAddr).Port)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer console.Close()
+
+    client, err := game.NewGT7Conn(conn, "127.0.0.1")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // packets are dropped until the console has heard the heartbeat
+    plain := gt7Packet(t)
+    done := make(chan struct{})
+    defer close(done)
+    go func() {
+        for {
+            select {
+            case <-done:
+                return
+            case <-time.After(10 * time.Millisecond):
+                console.Write(plain)
+            }
+        }
+    }()
+
+    read := make(chan []byte, 1)
+    go func() {
+        b := make([]byte, 1500)
+        n, _, err := client.ReadFromUDP(b)
+        if err != nil {
+            b, n = nil, 0
+        }
+        read <- b[:n]
+    }()
+
+    select {
+    case data := <-read:
+        if len(data) < 4 || binary.LittleEndian.Uint32(data) != gt7Magic {
+            t.Fatalf("streamed packet does not start with the GT7 magic: % X", data[:4])
+        }
+        if !sameExceptIV(data, plain) {
+            t.Error("streamed packet differs from the one sent")
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("no packet streamed after the heartbeat")
+    }
+}
+
+// sliceReader hands out datagrams, then io.EOF
+type sliceReader struct {
+    datagrams [][]byte
+}
+
+func (r *sliceReader) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+    if len(r.datagrams) == 0 {
+        return 0, nil, io.EOF
+    }
+    n := copy(b, r.datagrams[0])
+    r.datagrams = r.datagrams[1:]
+    return n, nil, nil
+}
+
+func TestGT7Splits(t *testing.T) {
+    format := loadFormat(t, filepath.Join(formatDir, "GT7_packetformat.dat"))
+    // three laps of the 3km track
+    packets := datagrams("GT7", format, 60*200)
+
+    // the second session is recognized as the same track
+    for session := 0; session < 2; session++ {
+        if err := game.Loop(context.Background(), "GT7", &sliceReader{datagrams: packets}, format); err != nil {
+            t.Fatal(err)
+        }
+        game.Flush()
+    }
+
+    lines, err := util.ReadLines(filepath.Join("data", "gt7tracks"))
+    if err != nil || len(lines) != 1 {
+        t.Fatalf("%d tracks stored (%v), want the simulated track", len(lines), err)
+    }
+    // splits are stored for car 1000, class unknown, on track 0
+    if _, err := os.Stat(filepath.Join("data", "splits", "-1", "1000", "0.json")); err != nil {
+        t.Errorf("no splits stored: %v", err)
+    }
+}
@@ -0,0 +1,166 @@
+package game
+
+import (
+    "math"
+)
+
+// outgauge handles the OutGauge (dashboard) and OutSim (motion) protocols
+// of BeamNG.drive and Live for Speed. Both streams are merged into one state,
+// they may arrive on the same port or on two ports at once.
+type outgauge struct {
+    baseGame
+}
+
+func init() {
+    Register(outgauge{})
+}
+
+// OutGauge Flags bits
+var outgaugeFlags = []struct {
+    bit  uint16
+    name string
+}{
+    {1 << 0, "ShiftKey"},
+    {1 << 1, "CtrlKey"},
+    {1 << 13, "HasTurbo"},
+    {1 << 14, "PrefersKmh"},
+    {1 << 15, "PrefersBar"},
+}
+
+// OutGauge DashLights bits, LFS uses all of them, BeamNG up to ABS
+var outgaugeLights = []string{
+    "ShiftLight",
+    "FullBeam",
+    "HandBrakeLight",
+    "PitSpeedLimiter",
+    "TractionControl",
+    "SignalLeft",
+    "SignalRight",
+    "SignalAny",
+    "OilWarning",
+    "BatteryWarning",
+    "ABS",
+    "EngineWarning",
+    "FogRear",
+    "FogFront",
+    "DippedBeam",
+    "FuelWarning",
+    "SideLights",
+    "NeutralLight",
+}
+
+// Names of the light availability flags, built once instead of for every packet
+var outgaugeLightsAvailable = func() []string {
+    names := make([]string, len(outgaugeLights))
+    for i, name := range outgaugeLights {
+        names[i] = name + "Available"
+    }
+    return names
+}()
+
+// Neither protocol sends the rev limit
+var outgaugeRpm rpmLimit
+
+func (outgauge) Identify(game string) bool {
+    return OutGauge(game)
+}
+
+func (outgauge) Describe(game string) string {
+    return OutGaugeGame(game)
+}
+
+func (outgauge) PostProcess(game string, packet *Packet, debug bool) bool {
+    // OutGauge is only sent while driving
+    packet.SetBool("IsRaceOn", true)
+
+    flags := packet.U16("Flags")
+    for _, flag := range outgaugeFlags {
+        packet.SetBool(flag.name, flags&flag.bit != 0)
+    }
+
+    lights := packet.U32("DashLights")
+    available := packet.U32("DashLightsAvailable")
+    for bit, name := range outgaugeLights {
+        packet.SetBool(name, lights&(1<<bit) != 0)
+        packet.SetBool(outgaugeLightsAvailable[bit], available&(1<<bit) != 0)
+    }
+
+    // Reverse 0, neutral 1 on the wire
+    if gear, ok := packet.LookupU8("Gear"); ok {
+        packet.SetS8("Gear", int8(gear) - 1)
+    }
+    packet.SetS32("GearNeutral", 0)
+    packet.SetS32("GearReverse", -1)
+
+    // Pedals on the 0-255 scale used by Forza
+    for _, key := range []string{"Accel", "Brake", "Clutch"} {
+        if pedal, ok := packet.LookupF32(key); ok {
+            packet.SetU8(key, uint8(math.Max(0, math.Min(1, float64(pedal))) * 255))
+        }
+    }
+    if packet.Bool("HandBrakeLight") {
+        packet.SetU8("HandBrake", 255)
+    } else {
+        packet.SetU8("HandBrake", 0)
+    }
+
+    // Turbo pressure in psi like Forza's Boost
+    if turbo, ok := packet.LookupF32("Turbo"); ok {
+        packet.SetF32("Boost", turbo * 14.5038)
+    }
+
+    // OutSim positions are fixed point
+    for _, key := range []string{"PositionX", "PositionY", "PositionZ"} {
+        if position, ok := packet.LookupS32(key); ok {
+            packet.SetF32(key, float32(position) / 65536)
+        }
+    }
+
+    packet.SetF32("EngineMaxRpm", outgaugeRpm.update(packet.Str("CarName"), packet.F32("CurrentEngineRpm")))
+
+    return true
+}
+
+func (outgauge) Fields(game string, decoded []Field) []Field {
+    fields := withFields(decoded, raceOnFields[0])
+    for _, flag := range outgaugeFlags {
+        fields = withFields(fields, Field{flag.name, "bool", ""})
+    }
+    for bit, name := range outgaugeLights {
+        fields = withFields(fields, Field{name, "bool", ""}, Field{outgaugeLightsAvailable[bit], "bool", ""})
+    }
+    fields = withFields(fields, Field{"Gear", "s8", ""})
+    fields = withFields(fields, raceOnFields[1:]...)
+    return withFields(fields,
+        Field{"Accel", "u8", "0..255"},
+        Field{"Brake", "u8", "0..255"},
+        Field{"Clutch", "u8", "0..255"},
+        Field{"HandBrake", "u8", "0..255"},
+        Field{"Boost", "f32", "psi"},
+        Field{"PositionX", "f32", "m"},
+        Field{"PositionY", "f32", "m"},
+        Field{"PositionZ", "f32", "m"},
+        Field{"EngineMaxRpm", "f32", "rpm"},
+    )
+}
+
+func OutGauge(game string) bool {
+    switch game {
+        case "BNG":
+        case "LFS":
+        default:
+            return false
+        }
+    return true
+}
+
+func OutGaugeGame(game string) string {
+    switch game {
+        case "BNG":
+            return "BeamNG.drive"
+        case "LFS":
+            return "Live for Speed"
+        default:
+            return "Unknown"
+        }
+}
@@ -0,0 +1,428 @@
+package game
+
+import (
+    "bytes"
+    "log"
+    "math"
+    "strconv"
+
+    "jesseboth/fdt/src/util"
+)
+
+// Packet holds the values of a datagram, one typed slot per value. The slots
+// are laid out once per format by a Layout shared with the other packets of
+// a decoder, so decoding writes a field straight into its slot and encoding
+// walks the slots in the order they are published.
+type Packet struct {
+    layout *Layout
+    slots  []slot
+}
+
+type slot struct {
+    kind util.ValueType // util.TypeNone while the value is not set
+    bits uint64         // integers, floats as their IEEE bits, bools as 0 or 1
+    str  string
+    obj  jsonAppender
+}
+
+// typeObject marks a slot holding a computed object like Normalized
+const typeObject = util.TypeString + 1
+
+// jsonAppender is a computed value that writes its own JSON
+type jsonAppender interface {
+    AppendJSON(b []byte) []byte
+}
+
+// Layout names the slots of packets and the order they are published in.
+// Values that are not laid out are added when they are first set, they are
+// published after the others.
+type Layout struct {
+    names []string
+    keys  []string // "Name": as written in the JSON
+    index map[string]int
+    order []int // slots in the order they are published
+}
+
+// NewLayout lays out the values of a format, the decoded fields first in the
+// order of their Slot, published in the order of fields
+func NewLayout(format *util.Format, fields []Field) *Layout {
+    l := &Layout{index: make(map[string]int)}
+    if format != nil {
+        for _, T := range format.AllFields() {
+            l.slot(T.Name)
+        }
+    }
+    for _, field := range fields {
+        l.slot(field.Name)
+    }
+
+    // schema order, then the fields it leaves out
+    published := make([]bool, len(l.names))
+    l.order = l.order[:0]
+    for _, field := range fields {
+        if i := l.index[field.Name]; !published[i] {
+            l.order = append(l.order, i)
+            published[i] = true
+        }
+    }
+    for i := range l.names {
+        if !published[i] {
+            l.order = append(l.order, i)
+        }
+    }
+    return l
+}
+
+// slot returns the slot of name, adding it if needed
+func (l *Layout) slot(name string) int {
+    if i, ok := l.index[name]; ok {
+        return i
+    }
+    i := len(l.names)
+    l.names = append(l.names, name)
+    l.keys = append(l.keys, string(appendString(nil, name))+":")
+    l.index[name] = i
+    l.order = append(l.order, i)
+    return i
+}
+
+// NewPacket returns an empty packet, a nil layout starts an empty one
+func NewPacket(layout *Layout) *Packet {
+    if layout == nil {
+        layout = NewLayout(nil, nil)
+    }
+    return &Packet{layout: layout, slots: make([]slot, len(layout.names))}
+}
+
+// at returns slot i, growing the packet if the layout has grown since
+func (p *Packet) at(i int) *slot {
+    if i >= len(p.slots) {
+        p.slots = append(p.slots, make([]slot, len(p.layout.names)-len(p.slots))...)
+    }
+    return &p.slots[i]
+}
+
+// set returns the slot of name to write a value into
+func (p *Packet) set(name string) *slot {
+    return p.at(p.layout.slot(name))
+}
+
+// get returns the slot of name, nil if the value is not set
+func (p *Packet) get(name string) *slot {
+    i, ok := p.layout.index[name]
+    if !ok || i >= len(p.slots) || p.slots[i].kind == util.TypeNone {
+        return nil
+    }
+    return &p.slots[i]
+}
+
+// lookup returns the bits of a value of the given type
+func (p *Packet) lookup(name string, kind util.ValueType) (uint64, bool) {
+    if s := p.get(name); s != nil && s.kind == kind {
+        return s.bits, true
+    }
+    return 0, false
+}
+
+func (p *Packet) setBits(name string, kind util.ValueType, bits uint64) {
+    s := p.set(name)
+    s.kind, s.bits = kind, bits
+}
+
+// Typed accessors, a value read with another type than it was set with is missing
+
+func (p *Packet) LookupS32(name string) (int32, bool) {
+    bits, ok := p.lookup(name, util.TypeS32)
+    return int32(bits), ok
+}
+
+func (p *Packet) LookupU32(name string) (uint32, bool) {
+    bits, ok := p.lookup(name, util.TypeU32)
+    return uint32(bits), ok
+}
+
+func (p *Packet) LookupF32(name string) (float32, bool) {
+    bits, ok := p.lookup(name, util.TypeF32)
+    return math.Float32frombits(uint32(bits)), ok
+}
+
+func (p *Packet) LookupU16(name string) (uint16, bool) {
+    bits, ok := p.lookup(name, util.TypeU16)
+    return uint16(bits), ok
+}
+
+func (p *Packet) LookupS16(name string) (int16, bool) {
+    bits, ok := p.lookup(name, util.TypeS16)
+    return int16(bits), ok
+}
+
+func (p *Packet) LookupU8(name string) (uint8, bool) {
+    bits, ok := p.lookup(name, util.TypeU8)
+    return uint8(bits), ok
+}
+
+func (p *Packet) LookupS8(name string) (int8, bool) {
+    bits, ok := p.lookup(name, util.TypeS8)
+    return int8(bits), ok
+}
+
+func (p *Packet) LookupU64(name string) (uint64, bool) {
+    return p.lookup(name, util.TypeU64)
+}
+
+func (p *Packet) LookupF64(name string) (float64, bool) {
+    bits, ok := p.lookup(name, util.TypeF64)
+    return math.Float64frombits(bits), ok
+}
+
+func (p *Packet) LookupBool(name string) (bool, bool) {
+    bits, ok := p.lookup(name, util.TypeBool)
+    return bits != 0, ok
+}
+
+func (p *Packet) LookupStr(name string) (string, bool) {
+    if s := p.get(name); s != nil && s.kind == util.TypeString {
+        return s.str, true
+    }
+    return "", false
+}
+
+func (p *Packet) S32(name string) int32     { v, _ := p.LookupS32(name); return v }
+func (p *Packet) U32(name string) uint32    { v, _ := p.LookupU32(name); return v }
+func (p *Packet) F32(name string) float32   { v, _ := p.LookupF32(name); return v }
+func (p *Packet) U16(name string) uint16    { v, _ := p.LookupU16(name); return v }
+func (p *Packet) S16(name string) int16     { v, _ := p.LookupS16(name); return v }
+func (p *Packet) U8(name string) uint8      { v, _ := p.LookupU8(name); return v }
+func (p *Packet) S8(name string) int8       { v, _ := p.LookupS8(name); return v }
+func (p *Packet) U64(name string) uint64    { v, _ := p.LookupU64(name); return v }
+func (p *Packet) F64(name string) float64   { v, _ := p.LookupF64(name); return v }
+func (p *Packet) Bool(name string) bool     { v, _ := p.LookupBool(name); return v }
+func (p *Packet) Str(name string) string    { v, _ := p.LookupStr(name); return v }
+
+func (p *Packet) SetS32(name string, v int32)   { p.setBits(name, util.TypeS32, uint64(v)) }
+func (p *Packet) SetU32(name string, v uint32)  { p.setBits(name, util.TypeU32, uint64(v)) }
+func (p *Packet) SetF32(name string, v float32) { p.setBits(name, util.TypeF32, uint64(math.Float32bits(v))) }
+func (p *Packet) SetU16(name string, v uint16)  { p.setBits(name, util.TypeU16, uint64(v)) }
+func (p *Packet) SetS16(name string, v int16)   { p.setBits(name, util.TypeS16, uint64(v)) }
+func (p *Packet) SetU8(name string, v uint8)    { p.setBits(name, util.TypeU8, uint64(v)) }
+func (p *Packet) SetS8(name string, v int8)     { p.setBits(name, util.TypeS8, uint64(v)) }
+func (p *Packet) SetU64(name string, v uint64)  { p.setBits(name, util.TypeU64, v) }
+func (p *Packet) SetF64(name string, v float64) { p.setBits(name, util.TypeF64, math.Float64bits(v)) }
+
+func (p *Packet) SetBool(name string, v bool) {
+    bits := uint64(0)
+    if v {
+        bits = 1
+    }
+    p.setBits(name, util.TypeBool, bits)
+}
+
+func (p *Packet) SetStr(name string, v string) {
+    s := p.set(name)
+    s.kind, s.str = util.TypeString, v
+}
+
+// SetObject sets a value that writes its own JSON
+func (p *Packet) SetObject(name string, v jsonAppender) {
+    s := p.set(name)
+    s.kind, s.obj = typeObject, v
+}
+
+// Has reports whether a value of any type is set
+func (p *Packet) Has(name string) bool {
+    return p.get(name) != nil
+}
+
+// Number reads a numeric value of any type, bools are 0 or 1
+func (p *Packet) Number(name string) (float64, bool) {
+    s := p.get(name)
+    if s == nil {
+        return 0, false
+    }
+    return s.number()
+}
+
+func (s *slot) number() (float64, bool) {
+    switch s.kind {
+    case util.TypeS32:
+        return float64(int32(s.bits)), true
+    case util.TypeS16:
+        return float64(int16(s.bits)), true
+    case util.TypeS8:
+        return float64(int8(s.bits)), true
+    case util.TypeU32, util.TypeU16, util.TypeU8, util.TypeU64, util.TypeBool:
+        return float64(s.bits), true
+    case util.TypeF32:
+        return float64(math.Float32frombits(uint32(s.bits))), true
+    case util.TypeF64:
+        return math.Float64frombits(s.bits), true
+    }
+    return 0, false
+}
+
+// Delete unsets a value
+func (p *Packet) Delete(name string) {
+    if s := p.get(name); s != nil {
+        s.kind = util.TypeNone
+    }
+}
+
+// Reset unsets every value, keeping the memory for the next datagram
+func (p *Packet) Reset() {
+    for i := range p.slots {
+        p.slots[i].kind = util.TypeNone
+    }
+}
+
+// Merge copies every value of other into p
+func (p *Packet) Merge(other *Packet) {
+    for i := range other.slots {
+        s := &other.slots[i]
+        if s.kind == util.TypeNone {
+            continue
+        }
+        if p.layout == other.layout {
+            *p.at(i) = *s
+        } else {
+            *p.set(other.layout.names[i]) = *s
+        }
+    }
+}
+
+// Copy returns a packet holding the same values
+func (p *Packet) Copy() *Packet {
+    packet := NewPacket(p.layout)
+    packet.Merge(p)
+    return packet
+}
+
+// Map returns the values by name, numbers keep their data type
+func (p *Packet) Map() map[string]interface{} {
+    values := make(map[string]interface{})
+    for i := range p.slots {
+        s := &p.slots[i]
+        switch s.kind {
+        case util.TypeNone:
+            continue
+        case util.TypeS32:
+            values[p.layout.names[i]] = int32(s.bits)
+        case util.TypeU32:
+            values[p.layout.names[i]] = uint32(s.bits)
+        case util.TypeF32:
+            values[p.layout.names[i]] = math.Float32frombits(uint32(s.bits))
+        case util.TypeU16:
+            values[p.layout.names[i]] = uint16(s.bits)
+        case util.TypeS16:
+            values[p.layout.names[i]] = int16(s.bits)
+        case util.TypeU8:
+            values[p.layout.names[i]] = uint8(s.bits)
+        case util.TypeS8:
+            values[p.layout.names[i]] = int8(s.bits)
+        case util.TypeU64:
+            values[p.layout.names[i]] = s.bits
+        case util.TypeF64:
+            values[p.layout.names[i]] = math.Float64frombits(s.bits)
+        case util.TypeBool:
+            values[p.layout.names[i]] = s.bits != 0
+        case util.TypeString:
+            values[p.layout.names[i]] = s.str
+        default:
+            values[p.layout.names[i]] = s.obj
+        }
+    }
+    return values
+}
+
+// AppendJSON writes the values that are set as a JSON object in layout
+// order, numbers that are not finite are null
+func (p *Packet) AppendJSON(b []byte) []byte {
+    b = append(b, '{')
+    first := true
+    for _, i := range p.layout.order {
+        if i >= len(p.slots) || p.slots[i].kind == util.TypeNone {
+            continue
+        }
+        if !first {
+            b = append(b, ',')
+        }
+        first = false
+        b = append(b, p.layout.keys[i]...)
+        b = p.slots[i].appendJSON(b)
+    }
+    return append(b, '}')
+}
+
+func (s *slot) appendJSON(b []byte) []byte {
+    switch s.kind {
+    case util.TypeS32:
+        return strconv.AppendInt(b, int64(int32(s.bits)), 10)
+    case util.TypeS16:
+        return strconv.AppendInt(b, int64(int16(s.bits)), 10)
+    case util.TypeS8:
+        return strconv.AppendInt(b, int64(int8(s.bits)), 10)
+    case util.TypeU32, util.TypeU16, util.TypeU8, util.TypeU64:
+        return strconv.AppendUint(b, s.bits, 10)
+    case util.TypeF32:
+        return appendFloat(b, float64(math.Float32frombits(uint32(s.bits))), 32)
+    case util.TypeF64:
+        return appendFloat(b, math.Float64frombits(s.bits), 64)
+    case util.TypeBool:
+        return strconv.AppendBool(b, s.bits != 0)
+    case util.TypeString:
+        return appendString(b, s.str)
+    case typeObject:
+        if s.obj != nil {
+            return s.obj.AppendJSON(b)
+        }
+    }
+    return append(b, "null"...)
+}
+
+// field returns the slot a decoded field is written to, the field's Slot
+// when the packet is laid out for its format
+func (p *Packet) field(T *util.Telemetry) *slot {
+    if names := p.layout.names; T.Slot < len(names) && names[T.Slot] == T.Name {
+        return p.at(T.Slot)
+    }
+    return p.set(T.Name)
+}
+
+// DecodePacket unpacks data into packet using the offsets in telemArray
+func DecodePacket(packet *Packet, data []byte, telemArray []util.Telemetry, debug bool) {
+    for i := range telemArray {
+        T := &telemArray[i]
+        chunk := data[T.StartOffset:T.EndOffset]
+        if debug {
+            log.Printf("Data chunk %d: %v (%s) (%s)", i, chunk, T.Name, T.DataType)
+        }
+        if T.Type == util.TypeNone {
+            continue
+        }
+
+        s := packet.field(T)
+        s.kind = T.Type
+        order := T.ByteOrder()
+        switch T.Type {
+        case util.TypeS32, util.TypeU32, util.TypeF32:
+            s.bits = uint64(order.Uint32(chunk))
+        case util.TypeU16, util.TypeS16:
+            s.bits = uint64(order.Uint16(chunk))
+        case util.TypeU8, util.TypeS8, util.TypeBool:
+            s.bits = uint64(chunk[0])
+            if T.Type == util.TypeBool && s.bits != 0 {
+                s.bits = 1
+            }
+        case util.TypeU64, util.TypeF64:
+            s.bits = order.Uint64(chunk)
+        case util.TypeString:
+            // the previous datagram usually holds the same string
+            if n := bytes.IndexByte(chunk, 0); n >= 0 {
+                chunk = chunk[:n]
+            }
+            chunk = bytes.TrimSpace(chunk)
+            if s.str != string(chunk) {
+                s.str = string(chunk)
+            }
+        }
+    }
+}
@@ -0,0 +1,289 @@
+package game
+
+import (
+    "hash/fnv"
+    "log"
+
+    "jesseboth/fdt/src/util"
+)
+
+// pcars handles the Slightly Mad Studios UDP protocol version 2 used by
+// Project CARS 2/3 and Automobilista 2. Telemetry, race definition,
+// participants, timings and game state packets are merged into one state,
+// the timings and names are read for the local participant.
+type pcars struct {
+    baseGame
+}
+
+func init() {
+    Register(pcars{})
+}
+
+const (
+    pcarsMaxParticipants  = 32
+    pcarsNamesPerPacket   = 16   // participants and vehicle names are sent 16 at a time
+    pcarsVehicleNamesSize = 1132 // packet 8 also carries the class names, in a longer packet
+)
+
+// Per participant arrays, the format files describe the first participant only
+type pcarsArray struct {
+    start, end int    // bytes of the arrays holding the first participant
+    stride     int    // size of one participant, 0 when every field is an array of its own
+    name       string // field that is empty for unused entries, "" for the timings
+}
+
+var pcarsArrays = map[int64]pcarsArray{
+    2: {start: 16, end: 1136, name: "DriverName"},
+    3: {start: 33, end: 1057, stride: 32},
+    8: {start: 12, end: 1132, stride: 70, name: "CarName"},
+}
+
+// Local participant from the last timings packet, names are matched against it
+var pcarsLocal = -1
+
+// Lap state, the protocol has no last lap time for the local participant
+var pcarsLap uint8
+var pcarsLapTime float32
+var pcarsLapValid bool
+var pcarsLastLap float32
+var pcarsBestLap float32
+var pcarsTrack string
+
+// Layout moved to the local participant, reused for every packet
+var pcarsShifted []util.Telemetry
+
+// pcarsReset forgets the participant and lap of the last session
+func pcarsReset() {
+    pcarsLocal = -1
+    pcarsLap = 0
+    pcarsLapTime = 0
+    pcarsLapValid = false
+    pcarsLastLap = 0
+    pcarsBestLap = 0
+    pcarsTrack = ""
+}
+
+func (pcars) Identify(game string) bool {
+    return PCars(game)
+}
+
+func (pcars) Describe(game string) string {
+    return PCarsGame(game)
+}
+
+// Decode moves the participant arrays to the local participant. Participant
+// and vehicle name packets without the local participant are skipped.
+func (pcars) Decode(data []byte, telemArray []util.Telemetry, packet *Packet, debug bool) bool {
+    packetType := int64(-1)
+    for _, T := range telemArray {
+        if T.Name == "PacketType" {
+            packetType, _ = T.Integer(data)
+        } else if T.Name == "LocalParticipantIndex" {
+            index, _ := T.Integer(data)
+            pcarsLocal = int(index)
+            if pcarsLocal >= pcarsMaxParticipants {
+                pcarsLocal = -1
+            }
+        }
+    }
+
+    array, ok := pcarsArrays[packetType]
+    if !ok {
+        DecodePacket(packet, data, telemArray, debug)
+        return true
+    }
+    if packetType == 8 && len(data) != pcarsVehicleNamesSize {
+        return false
+    }
+
+    slot := pcarsLocal
+    if array.name != "" {
+        slot = pcarsSlot(data, telemArray, array)
+    }
+    if slot < 0 {
+        if array.name != "" {
+            return false
+        }
+        DecodePacket(packet, data, telemArray, debug)
+        return true
+    }
+    pcarsShifted = pcarsShift(pcarsShifted, telemArray, array, slot)
+    DecodePacket(packet, data, pcarsShifted, debug)
+    return true
+}
+
+// pcarsSlot finds the local participant in a packet of 16 names, -1 if it is not there
+func pcarsSlot(data []byte, telemArray []util.Telemetry, array pcarsArray) int {
+    if pcarsLocal < 0 {
+        return -1
+    }
+    for slot := 0; slot < pcarsNamesPerPacket; slot++ {
+        index, name := int64(-1), ""
+        pcarsShifted = pcarsShift(pcarsShifted, telemArray, array, slot)
+        for _, T := range pcarsShifted {
+            if T.EndOffset > len(data) {
+                continue
+            }
+            if T.Name == "ParticipantIndex" || T.Name == "VehicleIndex" {
+                index, _ = T.Integer(data)
+            } else if T.Name == array.name {
+                name = util.CString(data[T.StartOffset:T.EndOffset])
+            }
+        }
+        if index == int64(pcarsLocal) && name != "" {
+            return slot
+        }
+    }
+    return -1
+}
+
+// pcarsShift moves the fields of array to slot, reusing the memory of shifted
+func pcarsShift(shifted []util.Telemetry, telemArray []util.Telemetry, array pcarsArray, slot int) []util.Telemetry {
+    shifted = append(shifted[:0], telemArray...)
+    for i, T := range telemArray {
+        if T.StartOffset >= array.start && T.EndOffset <= array.end {
+            stride := array.stride
+            if stride == 0 {
+                stride = T.EndOffset - T.StartOffset
+            }
+            T.StartOffset += slot * stride
+            T.EndOffset += slot * stride
+        }
+        shifted[i] = T
+    }
+    return shifted
+}
+
+func (pcars) PostProcess(game string, packet *Packet, debug bool) bool {
+    // Playing and in a session, menus, replays and pauses send telemetry too
+    state := packet.U8("GameState")
+    raceOn := state&0x07 == 2 && state>>4 != 0
+    packet.SetBool("IsRaceOn", raceOn)
+    packet.SetU8("SessionState", state >> 4)
+
+    gears := packet.U8("GearNumGears")
+    packet.SetU8("Gear", gears & 0x0F)
+    packet.SetU8("GearMax", gears >> 4)
+    packet.SetS32("GearNeutral", 0)
+    packet.SetS32("GearReverse", 15)
+
+    packet.SetU8("RacePosition", packet.U8("RacePosition")&0x7F)
+
+    tiresToFahrenheit(packet)
+
+    track := packet.Str("TrackName")
+    if config := packet.Str("TrackConfig"); config != "" {
+        track += " " + config
+    }
+    lap := packet.U8("LapNumber")
+    pcarsUpdateLap(packet, track, lap)
+
+    packet.SetF32("DistanceTraveled", -1)
+    if length := packet.F32("TrackLength"); lap > 0 && length > 0 {
+        packet.SetF32("DistanceTraveled", float32(lap-1)*length + float32(packet.U16("LapDistance")))
+    }
+
+    // Splits and odometers are stored by number, the names are hashed into one
+    car := CarDescription{
+        CarNumber:   pcarsNameNumber(packet.Str("CarName")),
+        TrackNumber: pcarsNameNumber(track),
+        CarClass:    int(packet.U32("CarClass")),
+    }
+    if timingData.Car != car {
+        timingData.Car = car
+        timingData.BestSplits, _ = getTimingSplits(car)
+        timingData.BestCarTrack, timingData.BestCarTrackSplits, _ = getBestCarforTrack(car)
+        if debug {
+            log.Printf("%s: %s on %s", PCarsGame(game), packet.Str("CarName"), track)
+        }
+    }
+
+    if lap > 0 {
+        lap--
+    }
+    // Nothing is stored until the car name has arrived
+    best := packet.F32("BestLap")
+    updateTiming(packet, uint16(lap), uint32(car.CarNumber), raceOn && car.CarNumber >= 0)
+    if raceOn && packet.F32("BestLap") == 0 {
+        packet.SetF32("BestLap", best)
+    }
+
+    return true
+}
+
+func (pcars) Fields(game string, decoded []Field) []Field {
+    fields := withFields(decoded, raceOnFields...)
+    fields = withFields(fields,
+        Field{"SessionState", "u8", ""},
+        Field{"Gear", "u8", ""},
+        Field{"GearMax", "u8", ""},
+    )
+    for _, key := range tireTemps {
+        fields = withFields(fields, Field{key, "f32", "F"})
+    }
+    fields = withFields(fields,
+        Field{"LastLap", "f32", "s"},
+        Field{"BestLap", "f32", "s"},
+        Field{"SessionBestLap", "f32", "s"},
+        Field{"DistanceTraveled", "f32", "m"},
+    )
+    return withFields(fields, timingFields...)
+}
+
+// pcarsUpdateLap keeps the last and best lap, taken from the lap time when a new lap starts
+func pcarsUpdateLap(packet *Packet, track string, lap uint8) {
+    if track != pcarsTrack || lap < pcarsLap {
+        pcarsTrack = track
+        pcarsLastLap = 0
+        pcarsBestLap = 0
+    } else if lap == pcarsLap+1 && pcarsLapTime > 0 {
+        pcarsLastLap = pcarsLapTime
+        if pcarsLapValid && (pcarsBestLap == 0 || pcarsLastLap < pcarsBestLap) {
+            pcarsBestLap = pcarsLastLap
+        }
+    }
+    pcarsLap = lap
+    pcarsLapTime = packet.F32("CurrentLap")
+    pcarsLapValid = packet.U8("RaceState")&0x08 == 0
+
+    packet.SetF32("LastLap", pcarsLastLap)
+    packet.SetF32("BestLap", pcarsBestLap)
+    packet.SetF32("SessionBestLap", pcarsBestLap)
+}
+
+// pcarsNameNumber turns a car or track name into a positive number, -1 while unknown
+func pcarsNameNumber(name string) int {
+    if name == "" {
+        return -1
+    }
+    h := fnv.New32a()
+    h.Write([]byte(name))
+    return int(h.Sum32() & 0x7FFFFFFF)
+}
+
+func (pcars) Mapping(game string) Mapping {
+    return baseMapping.With(Mapping{
+        "lap": {Key: "LapNumber"},
+    })
+}
+
+func PCars(game string) bool {
+    switch game {
+        case "PC2":
+        case "AMS2":
+        default:
+            return false
+        }
+    return true
+}
+
+func PCarsGame(game string) string {
+    switch game {
+        case "PC2":
+            return "Project CARS 2"
+        case "AMS2":
+            return "Automobilista 2"
+        default:
+            return "Unknown"
+        }
+}
@@ -0,0 +1,73 @@
+package game
+
+import (
+    "strconv"
+)
+
+// rbr handles Richard Burns Rally with the NGP physics plugin of the RSF
+// launcher. The values are renamed and converted to what the Dirt module
+// publishes so the rally dash works unchanged.
+type rbr struct {
+    baseGame
+}
+
+func init() {
+    Register(rbr{})
+}
+
+// The plugin has no rev limit
+var rbrRpm rpmLimit
+
+func (rbr) Identify(game string) bool {
+    return game == "RBR"
+}
+
+func (rbr) Describe(game string) string {
+    return "Richard Burns Rally"
+}
+
+func (rbr) Mapping(game string) Mapping {
+    return dirtMapping.With(Mapping{
+        "handbrake": {Key: "HandBrake"},
+        "lap":       {},
+        "distance":  {Key: "LapDistance"},
+    })
+}
+
+func (rbr) PostProcess(game string, packet *Packet, debug bool) bool {
+    packet.SetBool("IsRaceOn", true)
+
+    packet.SetF32("Speed", packet.F32("SpeedKmh") / 3.6)
+
+    // Reverse 0, neutral 1 on the wire, Dirt counts from reverse -1
+    gear := packet.S32("GearSelected")
+    packet.SetF32("Gear", float32(gear - 1))
+    packet.SetS32("GearNeutral", 0)
+    packet.SetS32("GearReverse", -1)
+
+    distance := packet.F32("LapDistance")
+    length := distance + packet.F32("DistanceToEnd")
+    packet.SetF32("StageLength", length)
+    packet.SetF32("StageProgress", 0)
+    if length > 0 {
+        packet.SetF32("StageProgress", distance / length)
+    }
+    // Dirt publishes the stage distance as Odometer, the rally dash shows it
+    packet.SetF32("Odometer", distance)
+
+    car := strconv.Itoa(int(packet.S32("CarIndex")))
+    packet.SetF32("EngineMaxRpm", rbrRpm.update(car, packet.F32("CurrentEngineRpm")))
+
+    return true
+}
+
+func (rbr) Fields(game string, decoded []Field) []Field {
+    return withFields(withFields(decoded, raceOnFields...),
+        Field{"Speed", "f32", "m/s"},
+        Field{"Gear", "f32", ""},
+        Field{"StageLength", "f32", "m"},
+        Field{"StageProgress", "f32", "0..1"},
+        Field{"Odometer", "f32", "m"},
+        Field{"EngineMaxRpm", "f32", "rpm"},
+    )
+}
@@ -0,0 +1,267 @@
+package game
+
+import (
+    "strconv"
+
+    "jesseboth/fdt/src/util"
+)
+
+// SchemaField describes one value of the normalized telemetry
+type SchemaField struct {
+    Name        string `json:"name"`
+    Type        string `json:"type"`
+    Unit        string `json:"unit,omitempty"`
+    Description string `json:"description"`
+}
+
+// Schema is the normalized telemetry every game is mapped to. It is published
+// as the Normalized object next to the game's own values, fields a game does
+// not send are null.
+var Schema = []SchemaField{
+    {"raceOn", "bool", "", "the car is on track and the values are live"},
+    {"rpm", "f32", "rpm", "engine speed"},
+    {"rpmMax", "f32", "rpm", "rev limit"},
+    {"rpmIdle", "f32", "rpm", "engine speed at idle"},
+    {"gear", "s8", "", "-1 reverse, 0 neutral, 1 and up forward gears"},
+    {"gearMax", "u8", "", "number of forward gears"},
+    {"speed", "f32", "m/s", "vehicle speed"},
+    {"throttle", "f32", "0..1", "throttle pedal"},
+    {"brake", "f32", "0..1", "brake pedal"},
+    {"clutch", "f32", "0..1", "clutch pedal, 1 is fully pressed"},
+    {"handbrake", "f32", "0..1", "handbrake lever"},
+    {"steer", "f32", "-1..1", "steering input, negative is left"},
+    {"fuel", "f32", "0..1", "fuel left as a fraction of the tank"},
+    {"position", "u8", "", "race position, from 1"},
+    {"lap", "u16", "", "current lap, from 1"},
+    {"lapTime", "f32", "s", "time of the current lap or stage"},
+    {"lastLap", "f32", "s", "time of the last completed lap"},
+    {"bestLap", "f32", "s", "best lap time"},
+    {"split", "f32", "s", "current lap against the best lap at the same distance"},
+    {"distance", "f32", "m", "distance traveled in the session or stage"},
+    {"odometer", "f32", "m", "distance traveled by the car over all sessions"},
+    {"tireTemp", "f32[4]", "C", "tire temperatures, front left, front right, rear left, rear right"},
+}
+
+// Order of every four wheel array in the schema
+var schemaWheels = []string{"FrontLeft", "FrontRight", "RearLeft", "RearRight"}
+
+// Tire temperature names, built once so packets do not concatenate them
+var tireTemps = wheelNames("TireTemp")
+
+// tiresToFahrenheit converts the Celsius tire temperatures of games that send
+// them, the dash colors expect Fahrenheit and the tireTemp mapping converts back
+func tiresToFahrenheit(packet *Packet) {
+    for _, key := range tireTemps {
+        if temp, ok := packet.LookupU8(key); ok {
+            packet.SetF32(key, util.CelsiusToFahrenheit(float32(temp)))
+        } else if temp, ok := packet.LookupF32(key); ok {
+            packet.SetF32(key, util.CelsiusToFahrenheit(temp))
+        }
+    }
+}
+
+// wheelNames returns prefix followed by every wheel in schema order
+func wheelNames(prefix string) []string {
+    names := make([]string, len(schemaWheels))
+    for i, wheel := range schemaWheels {
+        names[i] = prefix + wheel
+    }
+    return names
+}
+
+// Mapping tells where every normalized field comes from in a game's values,
+// fields without a source are null
+type Mapping map[string]Source
+
+// Source is a game value and the conversion to the schema unit
+type Source struct {
+    Key    string  // value name, four wheel arrays append FrontLeft .. RearRight
+    Scale  float64 // multiplier, 0 leaves the value unscaled
+    Offset float64 // added after scaling
+}
+
+// baseMapping reads the values the dashes were written for, Forza's names and units
+var baseMapping = Mapping{
+    "raceOn":    {Key: "IsRaceOn"},
+    "rpm":       {Key: "CurrentEngineRpm"},
+    "rpmMax":    {Key: "EngineMaxRpm"},
+    "rpmIdle":   {Key: "EngineIdleRpm"},
+    "gear":      {Key: "Gear"},
+    "gearMax":   {Key: "GearMax"},
+    "speed":     {Key: "Speed"},
+    "throttle":  {Key: "Accel", Scale: 1.0 / 255},
+    "brake":     {Key: "Brake", Scale: 1.0 / 255},
+    "clutch":    {Key: "Clutch", Scale: 1.0 / 255},
+    "handbrake": {Key: "HandBrake", Scale: 1.0 / 255},
+    "steer":     {Key: "Steer", Scale: 1.0 / 127},
+    "fuel":      {Key: "Fuel"},
+    "position":  {Key: "RacePosition"},
+    "lap":       {Key: "LapNumber", Offset: 1},
+    "lapTime":   {Key: "CurrentLap"},
+    "lastLap":   {Key: "LastLap"},
+    "bestLap":   {Key: "BestLap"},
+    "split":     {Key: "Split"},
+    "distance":  {Key: "DistanceTraveled"},
+    "odometer":  {Key: "Odometer"},
+    "tireTemp":  {Key: "TireTemp", Scale: 5.0 / 9, Offset: -160.0 / 9}, // Fahrenheit
+}
+
+// With returns a copy of the mapping with the sources in other replaced,
+// an empty Source removes the field
+func (m Mapping) With(other Mapping) Mapping {
+    mapping := make(Mapping, len(m)+len(other))
+    for field, source := range m {
+        mapping[field] = source
+    }
+    for field, source := range other {
+        if source.Key == "" {
+            delete(mapping, field)
+        } else {
+            mapping[field] = source
+        }
+    }
+    return mapping
+}
+
+// Forza marks neutral and reverse like this, games that do not say otherwise are read the same way
+const (
+    defaultGearNeutral = 11
+    defaultGearReverse = 0
+)
+
+// Normalized is the schema view of a packet, Update fills it in place so one
+// is allocated per loop. It is published as JSON in Schema order.
+type Normalized struct {
+    fields []normalField // one per Schema field
+}
+
+type normalField struct {
+    source Source
+    mapped bool     // the game has a source for the field
+    keys   []string // value names of four wheel arrays
+
+    set    bool
+    value  float64
+    wheels [4]float64
+    wheel  [4]bool // wheels the game sends
+}
+
+// NewNormalized prepares mapping packets to the schema
+func NewNormalized(mapping Mapping) *Normalized {
+    n := &Normalized{fields: make([]normalField, len(Schema))}
+    for i, field := range Schema {
+        normal := &n.fields[i]
+        normal.source, normal.mapped = mapping[field.Name]
+        if normal.mapped && field.Type == "f32[4]" {
+            normal.keys = wheelNames(normal.source.Key)
+        }
+    }
+    return n
+}
+
+// Update maps a post processed packet to the schema
+func (n *Normalized) Update(packet *Packet) {
+    for i, field := range Schema {
+        normal := &n.fields[i]
+        normal.set, normal.wheel = false, [4]bool{}
+        if !normal.mapped {
+            continue
+        }
+        source := normal.source
+
+        if normal.keys != nil {
+            for w, key := range normal.keys {
+                if value, ok := packet.Number(key); ok {
+                    normal.wheels[w] = source.convert(value)
+                    normal.wheel[w] = true
+                    normal.set = true
+                }
+            }
+            continue
+        }
+
+        value, ok := packet.Number(source.Key)
+        if !ok || (field.Name == "split" && value >= maxFloat) {
+            // no split to compare against yet
+            continue
+        }
+        value = source.convert(value)
+        if field.Name == "gear" {
+            value = normalGear(packet, value)
+        }
+        normal.value, normal.set = value, true
+    }
+}
+
+// AppendJSON writes the normalized values as a JSON object, fields a game does not send are null
+func (n *Normalized) AppendJSON(b []byte) []byte {
+    b = append(b, '{')
+    for i, field := range Schema {
+        if i > 0 {
+            b = append(b, ',')
+        }
+        b = appendString(b, field.Name)
+        b = append(b, ':')
+
+        normal := n.fields[i]
+        switch {
+        case !normal.set:
+            b = append(b, "null"...)
+        case field.Type == "f32[4]":
+            b = append(b, '[')
+            for w := range normal.wheels {
+                if w > 0 {
+                    b = append(b, ',')
+                }
+                if normal.wheel[w] {
+                    b = appendFloat(b, normal.wheels[w], 32)
+                } else {
+                    b = append(b, "null"...)
+                }
+            }
+            b = append(b, ']')
+        case field.Type == "bool":
+            b = strconv.AppendBool(b, normal.value != 0)
+        case field.Type == "f32":
+            b = appendFloat(b, normal.value, 32)
+        default:
+            b = strconv.AppendInt(b, int64(normal.value), 10)
+        }
+    }
+    return append(b, '}')
+}
+
+func (n *Normalized) MarshalJSON() ([]byte, error) {
+    return n.AppendJSON(nil), nil
+}
+
+func (s Source) convert(value float64) float64 {
+    if s.Scale != 0 {
+        value *= s.Scale
+    }
+    return value + s.Offset
+}
+
+// normalGear turns a game gear into -1 reverse, 0 neutral and 1 and up forward
+func normalGear(packet *Packet, gear float64) float64 {
+    neutral, ok := packet.Number("GearNeutral")
+    if !ok {
+        neutral = defaultGearNeutral
+    }
+    reverse, ok := packet.Number("GearReverse")
+    if !ok {
+        reverse = defaultGearReverse
+    }
+
+    switch {
+    case gear == reverse:
+        return -1
+    case gear == neutral:
+        return 0
+    case gear > neutral:
+        // forward gears counted on from neutral, ie: reverse 0, neutral 1, first 2
+        return gear - neutral
+    default:
+        return gear
+    }
+}
@@ -0,0 +1,21 @@
+package game
+
+import (
+    "jesseboth/fdt/src/util"
+)
+
+// applyTransforms runs the transforms of the packet format, transforms
+// with a missing input are skipped
+func applyTransforms(packet *Packet, transforms []util.Transform) {
+    for _, transform := range transforms {
+        value, ok := transform.Apply(packet.Number)
+        if !ok {
+            continue
+        }
+        if transform.Kind == "enum" {
+            packet.SetStr(transform.Name, transform.Label(value))
+            continue
+        }
+        packet.SetF32(transform.Name, float32(value))
+    }
+}
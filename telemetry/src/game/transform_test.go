@@ -0,0 +1,98 @@
+package game
+
+import (
+    "encoding/binary"
+    "math"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "jesseboth/fdt/src/util"
+)
+
+const transformFormat = `
+u16 EngineRpm;
+u8 LapNumber;
+f32 Speed;
+u8 Weather;
+f32 StageLength;
+f32 Odometer;
+
+scale EngineRpm 10;
+offset LapNumber 1;
+unit Speed mph m/s;
+enum Weather WeatherName 0=Clear, 1=Light Cloud;
+derive DistanceLeft = (StageLength - Odometer) / 1000;
+derive ShiftRpm = EngineRpm * 0.9;
+`
+
+// transformed decodes raw values laid out by the format and runs its transforms
+func transformed(t *testing.T, format *util.Format, raw map[string]float64) *Packet {
+    t.Helper()
+    data := make([]byte, format.Length)
+    for _, T := range format.Fields {
+        chunk := data[T.StartOffset:T.EndOffset]
+        switch T.DataType {
+        case "u8":
+            chunk[0] = uint8(raw[T.Name])
+        case "u16":
+            binary.LittleEndian.PutUint16(chunk, uint16(raw[T.Name]))
+        case "f32":
+            binary.LittleEndian.PutUint32(chunk, math.Float32bits(float32(raw[T.Name])))
+        }
+    }
+
+    packet := NewPacket(NewLayout(format, nil))
+    DecodePacket(packet, data, format.Fields, false)
+    applyTransforms(packet, format.Transforms)
+    return packet
+}
+
+func TestApplyTransforms(t *testing.T) {
+    file := filepath.Join(t.TempDir(), "TEST_packetformat.dat")
+    if err := os.WriteFile(file, []byte(transformFormat), 0644); err != nil {
+        t.Fatal(err)
+    }
+    format, err := util.LoadFormat(file, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    raw := map[string]float64{
+        "EngineRpm": 650, "LapNumber": 2, "Speed": 100, "Weather": 1, "StageLength": 5000, "Odometer": 1500,
+    }
+    packet := transformed(t, format, raw)
+    want := map[string]float64{
+        "EngineRpm":    6500,
+        "LapNumber":    3,
+        "Speed":        44.704,
+        "Weather":      1,
+        "DistanceLeft": 3.5,
+        "ShiftRpm":     5850, // derived from the scaled value
+    }
+    for name, value := range want {
+        got, ok := packet.Number(name)
+        if !ok || math.Abs(got-value) > 1e-6*math.Max(1, math.Abs(value)) {
+            t.Errorf("%s is %v (%v), want %v", name, got, ok, value)
+        }
+    }
+    if packet.Str("WeatherName") != "Light Cloud" {
+        t.Errorf("WeatherName is %q, want Light Cloud", packet.Str("WeatherName"))
+    }
+
+    // values without a label are published as the number
+    raw["Weather"] = 5
+    if name := transformed(t, format, raw).Str("WeatherName"); name != "5" {
+        t.Errorf("unlabeled WeatherName is %q, want 5", name)
+    }
+}
+
+func TestTransformUnknownValue(t *testing.T) {
+    file := filepath.Join(t.TempDir(), "TEST_packetformat.dat")
+    if err := os.WriteFile(file, []byte("f32 Speed;\nderive Left = Length - Speed;\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := util.LoadFormat(file, false); err == nil {
+        t.Error("transform reading an unknown value loaded")
+    }
+}
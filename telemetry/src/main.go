@@ -1,160 +1,178 @@
 package main
 
 import (
+    "context"
     "flag"
     "log"
-    "net"
+    "net/http"
     "os"
     "os/signal"
+    "strconv"
     "strings"
     "syscall"
+    "time"
 
     "jesseboth/fdt/src/util"
     "jesseboth/fdt/src/game"
 )
 
 const hostname = "0.0.0.0"            // Address to listen on (0.0.0.0 = all interfaces)
+const shutdownTimeout = 5 * time.Second // Longest wait for the data to be stored on exit
 
 func main() {
+    if len(os.Args) > 1 && os.Args[1] == "simulate" {
+        simulate(os.Args[2:])
+        return
+    }
+    if len(os.Args) > 1 && os.Args[1] == "format" {
+        os.Exit(formatCommand(os.Args[2:]))
+    }
+
     var gameSTR string
     var splitTypeSTR string
     var portSTR string
-
-    flag.StringVar(&gameSTR, "game", "FM", "Specify an abbreviated game ie: FM, FH5")
+    var streamRate int
+    var recordFile string
+    var replayFile string
+    var replaySpeed float64
+    var replaySeek time.Duration
+    var replayLoop bool
+    var remoteHost string
+    var password string
+    var outsimPortSTR string
+
+    flag.StringVar(&gameSTR, "game", "FM", "Specify an abbreviated game ie: FM, FH5, or auto to detect it")
     flag.StringVar(&splitTypeSTR, "split", "car", "car(overall)/class(overall)/session based splits")
     flag.StringVar(&portSTR, "port", "9999", "UDP port number to listen on")
+    flag.IntVar(&streamRate, "wsrate", 60, "Maximum frames per second pushed to each websocket client (0 = unlimited)")
+    flag.StringVar(&recordFile, "record", "", "Record every received datagram to a session file")
+    flag.StringVar(&replayFile, "replay", "", "Replay a recorded session file instead of listening for UDP")
+    flag.Float64Var(&replaySpeed, "speed", 1, "Replay speed multiplier")
+    flag.DurationVar(&replaySeek, "seek", 0, "Skip the start of the replayed session, ie: 1m30s")
+    flag.BoolVar(&replayLoop, "loop", false, "Restart the replayed session when it ends")
+    flag.StringVar(&remoteHost, "host", "", "IP address of the console or PC running the game, for games that must be asked for telemetry (GT7, AC, ACC)")
+    flag.StringVar(&password, "password", "asd", "ACC broadcasting connection password (connectionPassword in broadcasting.json)")
+    flag.StringVar(&outsimPortSTR, "outsim", "", "Second UDP port to listen on for OutSim when it is not sent to -port (BNG, LFS)")
     debugModePTR := flag.Bool("d", false, "Enables extra debug information if set")
     flag.Parse()
 
-    service := hostname + ":" + portSTR // Combined hostname+port
-
-    if game.Forza(gameSTR) {
-        game.ForzaSetSplit(splitTypeSTR)
-    }
-
-    debugMode := *debugModePTR
-
-    setupCloseHandler() // handle CTRL+C
-
-    if debugMode {
-        log.Println("Debug mode enabled")
+    // GT7 always sends to a fixed port
+    portSet := false
+    flag.Visit(func(f *flag.Flag) {
+        portSet = portSet || f.Name == "port"
+    })
+    if game.GT7(gameSTR) && !portSet {
+        portSTR = strconv.Itoa(game.GT7Port)
     }
 
-    var formatFile = "packets/" + gameSTR + "_packetformat.dat"
-
-    // Load lines from packet format file
-    var lines []string
-    var telemArray []util.Telemetry
-    var totalLength int
-    var err error
-
-    lines, err = util.ReadLines(formatFile)
+    port, err := strconv.Atoi(portSTR)
     if err != nil {
-        log.Fatalf("Error reading format file: %s", err)
+        log.Fatalf("Error: invalid port %s", portSTR)
     }
-
-    // Process format file into array of util.Telemetry structs
-    startOffset := 0
-    endOffset := 0
-
-    for i, line := range lines {
-        dataClean := strings.Split(line, ";")
-        dataFormat := strings.Split(dataClean[0], " ")
-        
-        // check if dataFormat has at least 2 elements if not, skip this line
-        if len(dataFormat) < 2 {
-            if debugMode {
-                log.Printf("Warning: Skipping malformed line %d in %s: %s", i, formatFile, line)
-            }
-            continue
-        } else if (strings.HasPrefix(dataFormat[0], "//")) {
-            // make sure line is not a comment
-            if debugMode {
-                log.Printf("Skipping comment line %d in %s", i, formatFile)
-            }
-            continue
-        }
-        
-        dataType := dataFormat[0]
-        dataName := dataFormat[1]
-
-        if debugMode {
-            log.Printf("DataType: %s, DataName: %s", dataType, dataName)
-        }
-
-        var dataLength int
-
-        switch dataType {
-        case "s32", "u32", "f32":
-            dataLength = 4
-        case "u16":
-            dataLength = 2
-        case "u8", "s8", "bool":
-            dataLength = 1
-        case "u64", "f64":
-            dataLength = 8
-        case "hzn":
-            dataLength = 12
-        default:
-            log.Fatalf("Error: Unknown data type '%s' in %s \n", dataType, formatFile)
+    outsimPort := 0
+    if outsimPortSTR != "" {
+        if outsimPort, err = strconv.Atoi(outsimPortSTR); err != nil {
+            log.Fatalf("Error: invalid outsim port %s", outsimPortSTR)
         }
+    }
 
-        // Compute offsets and append telemetry item
-        endOffset += dataLength
-        startOffset = endOffset - dataLength
-        totalLength += dataLength
-        telemItem := util.Telemetry{i, dataName, dataType, startOffset, endOffset}
-        telemArray = append(telemArray, telemItem)
+    if strings.EqualFold(gameSTR, game.Auto) {
+        gameSTR = game.Auto
+    }
+    config := Config{
+        Game:        gameSTR,
+        Split:       splitTypeSTR,
+        Port:        port,
+        Outsim:      outsimPort,
+        Host:        remoteHost,
+        Password:    password,
+        Debug:       *debugModePTR,
+        Capture:     true,
+        Replay:      replayFile,
+        ReplaySpeed: replaySpeed,
+        ReplaySeek:  replaySeek,
+        ReplayLoop:  replayLoop,
+    }
+    if err := validConfig(config); err != nil {
+        log.Fatalf("Error: %s", err)
+    }
 
-        if debugMode {
-            log.Printf("Processed %s line %d: %s (%s),  Byte offset: %d:%d \n",
-                formatFile, i, dataName, dataType, startOffset, endOffset)
+    var recorder *util.Recorder
+    if recordFile != "" {
+        recorder, err = util.NewRecorder(nil, recordFile)
+        if err != nil {
+            log.Fatal(err)
         }
+        log.Printf("Recording session to %s\n", recordFile)
     }
 
-    if debugMode {
-        log.Printf("Logging entire telemArray: \n%v", telemArray)
-        log.Printf("Processed %d util.Telemetry types OK!", len(telemArray))
+    telemetry := newPipeline(config, recorder)
+    if err := telemetry.Start(); err != nil {
+        log.Fatalf("Error: %s", err)
     }
 
+    util.SetStreamRate(streamRate)
+    http.HandleFunc("/control", telemetry.controlResponder)
     go util.ServeJson()
 
-    // Setup UDP listener
-    udpAddr, err := net.ResolveUDPAddr("udp4", service)
-    if err != nil {
-        log.Fatal(err)
-    }
+    // CTRL+C or SIGTERM stops the loop, a second one exits right away
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
 
-    listener, err := net.ListenUDP("udp", udpAddr)
-    if err != nil {
-        log.Fatal(err)
+    var loopErr error
+    select {
+    case loopErr = <-telemetry.ended:
+        if loopErr == nil && replayFile != "" {
+            log.Println("Replay finished")
+        }
+    case <-ctx.Done():
+        log.Println("Shutting down")
     }
-    defer listener.Close()
+    stop()
 
-    if debugMode {
-        log.Printf("Telemetry data out server listening on %s:%s, waiting for data...\n", util.GetOutboundIP(), portSTR)
-        log.Printf("Length of telemetry packet: %d bytes\n", totalLength)
-    } else {
-        log.Printf("Reading data on port %s\n", portSTR)
+    if !shutdown(telemetry) || loopErr != nil {
+        if loopErr != nil {
+            log.Printf("Error: %v", loopErr)
+        }
+        os.Exit(1)
     }
+}
 
+// run detects the game if asked to, then reads telemetry until the source is exhausted or closed
+func run(ctx context.Context, gameSTR string, autoDetect bool, splitTypeSTR string, source util.PacketReader, format *util.Format) error {
+    if autoDetect {
+        detected, err := game.Detect(source, util.FormatDir, game.Debugging())
+        if err != nil {
+            if ctx.Err() != nil {
+                return nil
+            }
+            return err
+        }
+        gameSTR = detected.Game
+        format = detected.Format
+    }
+    util.SetGame(gameSTR, game.Lookup(gameSTR).Describe(gameSTR), autoDetect)
 
-    if game.Forza(gameSTR) {
-        go game.ForzaLoop(gameSTR, listener, telemArray, totalLength, debugMode)
-    } else if game.Dirt(gameSTR) {
-        go game.DirtLoop(gameSTR, listener, telemArray, totalLength, debugMode)
-    } else {
-        go game.DefaultLoop(gameSTR, listener, telemArray, totalLength, debugMode)
+    if game.Forza(gameSTR) || game.PCars(gameSTR) || game.GT7(gameSTR) {
+        if err := game.ForzaSetSplit(splitTypeSTR); err != nil {
+            log.Printf("Error: %v", err)
+        }
     }
 
-    for {}
+    return game.Loop(ctx, gameSTR, source, format)
 }
 
-func setupCloseHandler() {
-    c := make(chan os.Signal, 2)
-    signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-    go func() {
-        <-c
-        os.Exit(0)
-    }()
+// shutdown stops reading and recording, stores the odometer and timing data
+// and stops the JSON server. It reports false if that did not finish within
+// shutdownTimeout.
+func shutdown(telemetry *pipeline) bool {
+    ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+    defer cancel()
+
+    stopped := telemetry.Close(shutdownTimeout)
+    if err := util.StopJson(ctx); err != nil {
+        log.Printf("Error stopping JSON server: %v", err)
+        return false
+    }
+    return stopped
 }
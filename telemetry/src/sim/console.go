@@ -0,0 +1,91 @@
+package sim
+
+import (
+    "log"
+    "net"
+    "sync"
+    "time"
+
+    "jesseboth/fdt/src/game"
+)
+
+// A console stops streaming when it has not heard a heartbeat for this long
+const consoleTimeout = 10 * time.Second
+
+// Console stands in for a PlayStation running GT7. It waits for the
+// heartbeat and sends encrypted packets back to the address it came from,
+// so the GT7 client can be exercised without a console.
+type Console struct {
+    conn *net.UDPConn
+    port int // port the telemetry is sent to, the real console always uses game.GT7Port
+    iv   uint32
+
+    mu     sync.Mutex
+    client *net.UDPAddr
+    heard  time.Time
+}
+
+// NewConsole listens for heartbeats on the GT7 heartbeat port
+func NewConsole(port int) (*Console, error) {
+    conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: game.GT7HeartbeatPort})
+    if err != nil {
+        return nil, err
+    }
+
+    c := &Console{
+        conn: conn,
+        port: port,
+        iv:   uint32(time.Now().UnixNano()),
+    }
+    go c.listen()
+    return c, nil
+}
+
+func (c *Console) listen() {
+    buffer := make([]byte, 64)
+    for {
+        n, addr, err := c.conn.ReadFromUDP(buffer)
+        if err != nil {
+            return
+        }
+        if n == 0 || buffer[0] != 'A' {
+            continue
+        }
+
+        client := &net.UDPAddr{IP: addr.IP, Port: c.port}
+        c.mu.Lock()
+        if c.client == nil || !c.client.IP.Equal(client.IP) {
+            log.Printf("Heartbeat from %s, streaming to %s", addr, client)
+        }
+        c.client = client
+        c.heard = time.Now()
+        c.mu.Unlock()
+    }
+}
+
+// Write encrypts a packet and sends it to the client, packets are dropped
+// while no client is sending heartbeats
+func (c *Console) Write(packet []byte) (int, error) {
+    c.mu.Lock()
+    client := c.client
+    if client != nil && time.Since(c.heard) > consoleTimeout {
+        log.Printf("No heartbeat from %s for %s, pausing", client.IP, consoleTimeout)
+        c.client = nil
+        client = nil
+    }
+    c.mu.Unlock()
+
+    if client == nil {
+        return len(packet), nil
+    }
+
+    data := append([]byte(nil), packet...)
+    c.iv++
+    game.GT7Encrypt(data, c.iv)
+    return c.conn.WriteToUDP(data, client)
+}
+
+// Close stops listening for heartbeats
+func (c *Console) Close() error {
+    return c.conn.Close()
+}
@@ -0,0 +1,319 @@
+package sim
+
+import (
+    "math"
+    "strconv"
+    "strings"
+
+    "jesseboth/fdt/src/game"
+    "jesseboth/fdt/src/util"
+)
+
+// Car drives laps around a closed loop track with a simple speed profile,
+// two slow corners per lap and standing start. All values are SI units
+// (m, m/s, s) until a game specific encoding is applied.
+type Car struct {
+    TrackLength float64
+
+    lapDistance  float64 // distance into the current lap
+    distance     float64 // total distance driven
+    speed        float64
+    acceleration float64
+    gear         int
+    rpm          float64
+    lap          int
+    currentLap   float64
+    lastLap      float64
+    bestLap      float64
+    raceTime     float64
+}
+
+const (
+    idleRpm = 900.0
+    maxRpm  = 8000.0
+    gearMax = 6
+)
+
+// top speed per gear in m/s, index 0 is unused
+var gearTopSpeed = [gearMax + 1]float64{0, 16, 26, 36, 46, 56, 70}
+
+// NewCar returns a car standing on the start line of a track of the given length in meters
+func NewCar(trackLength float64) *Car {
+    return &Car{
+        TrackLength: trackLength,
+        gear:        1,
+        rpm:         idleRpm,
+    }
+}
+
+// Lap returns the number of completed laps
+func (c *Car) Lap() int {
+    return c.lap
+}
+
+// targetSpeed is the speed the driver aims for at a point on the lap
+func (c *Car) targetSpeed(lapDistance float64) float64 {
+    return 30 + 25*(0.5+0.5*math.Cos(4*math.Pi*lapDistance/c.TrackLength))
+}
+
+// Step advances the simulation by dt seconds
+func (c *Car) Step(dt float64) {
+    c.acceleration = math.Max(-12, math.Min(6, (c.targetSpeed(c.lapDistance)-c.speed)*1.5))
+    c.speed = math.Max(0, c.speed+c.acceleration*dt)
+
+    traveled := c.speed * dt
+    c.distance += traveled
+    c.lapDistance += traveled
+    c.currentLap += dt
+    c.raceTime += dt
+
+    if c.lapDistance >= c.TrackLength {
+        // Split the frame between the finished lap and the new one
+        over := (c.lapDistance - c.TrackLength) / math.Max(c.speed, 0.001)
+        c.lastLap = c.currentLap - over
+        if c.bestLap == 0 || c.lastLap < c.bestLap {
+            c.bestLap = c.lastLap
+        }
+        c.currentLap = over
+        c.lapDistance -= c.TrackLength
+        c.lap++
+    }
+
+    c.gear = gearMax
+    for g := 1; g <= gearMax; g++ {
+        if c.speed < gearTopSpeed[g]*0.95 {
+            c.gear = g
+            break
+        }
+    }
+    c.rpm = math.Min(maxRpm, idleRpm+(maxRpm-idleRpm)*c.speed/gearTopSpeed[c.gear])
+}
+
+// Values returns the car state keyed by the field names used in the packet format files
+func (c *Car) Values() map[string]float64 {
+    radius := c.TrackLength / (2 * math.Pi)
+    angle := 2 * math.Pi * c.lapDistance / c.TrackLength
+    progress := c.lapDistance / c.TrackLength
+
+    accel, brake := 0.0, 0.0
+    if c.acceleration > 0 {
+        accel = c.acceleration / 6
+    } else {
+        brake = -c.acceleration / 12
+    }
+
+    values := map[string]float64{
+        "IsRaceOn":              1,
+        "TimestampMS":           c.raceTime * 1000,
+        "EngineMaxRpm":          maxRpm,
+        "EngineIdleRpm":         idleRpm,
+        "CurrentEngineRpm":      c.rpm,
+        "PositionX":             radius * math.Cos(angle),
+        "PositionY":             5 * math.Sin(2*angle),
+        "PositionZ":             radius * math.Sin(angle),
+        "VelocityX":             -c.speed * math.Sin(angle),
+        "VelocityZ":             c.speed * math.Cos(angle),
+        "AccelerationX":         c.speed * c.speed / radius,
+        "AccelerationZ":         c.acceleration,
+        "Yaw":                   angle + math.Pi/2,
+        "Speed":                 c.speed,
+        "SpeedMs":               c.speed,
+        "SpeedKmh":              c.speed * 3.6,
+        "Power":                 200000 * accel,
+        "Torque":                400 * accel,
+        "Accel":                 accel,
+        "Brake":                 brake,
+        "Steer":                 0.1,
+        "Gear":                  float64(c.gear),
+        "GearMax":               gearMax,
+        "GearNeutral":           0,
+        "DistanceTraveled":      c.distance,
+        "Odometer":              c.distance,
+        "LapDistance":           c.lapDistance,
+        "StageCurrentDistance":  c.lapDistance,
+        "StageProgress":         progress,
+        "Progress":              progress,
+        "CarPositionNormalized": progress,
+        "StageLength":           c.TrackLength,
+        "LapNumber":             float64(c.lap),
+        "LapsCompleted":         float64(c.lap),
+        "CurrentLap":            c.currentLap,
+        "LapTime":               c.currentLap,
+        "LastLap":               c.lastLap,
+        "BestLap":               c.bestLap,
+        "SessionBestLap":        c.bestLap,
+        "CurrentRaceTime":       c.raceTime,
+        "GameTotalTime":         c.raceTime,
+        "RacePosition":          1,
+        "CarPosition":           1,
+        "Fuel":                  math.Max(0.05, 1-c.distance/100000),
+        "FuelInTank":            math.Max(3, 60-c.distance/1500),
+        "FuelCapacity":          60,
+        "CarOrdinal":            1000,
+        "CarClass":              3,
+        "CarPerformanceIndex":   700,
+        "DrivetrainType":        1,
+        "NumCylinders":          6,
+        "TrackOrdinal":          1,
+    }
+
+    for _, tire := range []string{"FrontLeft", "FrontRight", "RearLeft", "RearRight"} {
+        values["TireTemp"+tire] = 180 + 20*accel
+        values["WheelRotationSpeed"+tire] = c.speed / 0.33
+    }
+
+    return values
+}
+
+// pedals are 0..1 floats, integer fields hold them as 0..255
+var pedals = map[string]bool{"Accel": true, "Brake": true, "Clutch": true, "HandBrake": true}
+
+// lap times are seconds, integer fields hold them as milliseconds
+var lapTimes = map[string]bool{"CurrentLap": true, "LastLap": true, "BestLap": true}
+
+// Adjust applies the units a game uses on the wire
+func Adjust(gameSTR string, values map[string]float64) {
+    if game.Dirt(gameSTR) {
+        // Dirt sends engine speeds in tens of RPM
+        for _, key := range []string{"CurrentEngineRpm", "EngineMaxRpm", "EngineIdleRpm"} {
+            values[key] /= 10
+        }
+    }
+
+    if game.F1(gameSTR) {
+        // F1 counts laps from 1, tire temperatures are Celsius
+        year, _ := strconv.Atoi(strings.TrimPrefix(gameSTR, "F1"))
+        values["GameYear"] = float64(year)
+        values["PacketFormat"] = float64(2000 + year)
+        values["LapNumber"]++
+        for _, tire := range []string{"FrontLeft", "FrontRight", "RearLeft", "RearRight"} {
+            values["TireTemp"+tire] = (values["TireTemp"+tire] - 32) * 5 / 9
+        }
+    }
+
+    if game.GT7(gameSTR) {
+        // GT7 counts laps from 1 and frames at 60Hz, tire temperatures are Celsius
+        values["Magic"] = 0x47375330
+        values["Flags"] = 0x1 | 0x8 // on track, in gear
+        values["Gears"] = values["Gear"]
+        values["PacketId"] = math.Round(values["TimestampMS"] * 60 / 1000)
+        values["LapNumber"]++
+        if values["BestLap"] == 0 {
+            values["BestLap"], values["LastLap"] = -0.001, -0.001
+        }
+        for _, tire := range []string{"FrontLeft", "FrontRight", "RearLeft", "RearRight"} {
+            values["TireTemp"+tire] = (values["TireTemp"+tire] - 32) * 5 / 9
+        }
+    }
+
+    if game.PCars(gameSTR) {
+        // Playing a race, gears share a byte with the gear count, laps count from 1
+        values["GameState"] = 2 | 5<<4
+        values["GearNumGears"] = values["Gear"] + gearMax*16
+        values["LapNumber"]++
+        values["TrackLength"] = values["StageLength"]
+        for _, tire := range []string{"FrontLeft", "FrontRight", "RearLeft", "RearRight"} {
+            values["TireTemp"+tire] = (values["TireTemp"+tire] - 32) * 5 / 9
+        }
+    }
+
+    if game.OutGauge(gameSTR) {
+        // OutGauge gears start at reverse 0, OutSim positions are 1/65536 m
+        values["Gear"]++
+        for _, axis := range []string{"X", "Y", "Z"} {
+            values["Position"+axis] *= 65536
+        }
+    }
+
+    if gameSTR == "RBR" {
+        // RBR gears start at reverse 0, the stage distance is split in driven and remaining
+        values["GearSelected"] = values["Gear"] + 1
+        values["DistanceToEnd"] = values["StageLength"] - values["LapDistance"]
+    }
+
+    if gameSTR == "ACC" {
+        // ACC sends gears offset by 2 so reverse is 0, the simulated car is always focused
+        values["Gear"] += 2
+        values["Laps"] = values["LapsCompleted"]
+        values["SessionPhase"] = 5
+        values["SessionType"] = 10
+    }
+
+    if gameSTR == "AC" {
+        values["Identifier"] = 'a'
+        values["Gear"]++ // reverse 0, neutral 1
+        values["Speed"] = values["Speed"] * 2.23694 // mph
+    }
+}
+
+// Packets encodes values into every packet kind of the format
+func Packets(values map[string]float64, format *util.Format) [][]byte {
+    if !format.Multi() {
+        return [][]byte{Encode(values, format.Fields, format.Length)}
+    }
+
+    packets := make([][]byte, 0, len(format.Kinds))
+    for _, kind := range format.Kinds {
+        values[format.Key] = float64(kind.ID)
+        packets = append(packets, Encode(values, kind.Fields, kind.Length))
+    }
+    return packets
+}
+
+// Encode lays values out in a packet described by telemArray, fields without a value are left zero
+func Encode(values map[string]float64, telemArray []util.Telemetry, totalLength int) []byte {
+    packet := make([]byte, totalLength)
+
+    for _, T := range telemArray {
+        value, ok := values[T.Name]
+        if T.Name == "Size" {
+            value, ok = float64(totalLength), true
+        }
+        if !ok {
+            continue
+        }
+
+        data := packet[T.StartOffset:T.EndOffset]
+        integer := T.DataType != "f32" && T.DataType != "f64"
+        if integer && pedals[T.Name] {
+            value *= 255
+        } else if integer && T.Name == "Steer" {
+            value *= 127
+        } else if integer && lapTimes[T.Name] {
+            value *= 1000
+        }
+
+        order := T.ByteOrder()
+        switch T.DataType {
+        case "s32":
+            order.PutUint32(data, uint32(int32(clamp(value, math.MinInt32, math.MaxInt32))))
+        case "u32":
+            order.PutUint32(data, uint32(clamp(value, 0, math.MaxUint32)))
+        case "f32":
+            order.PutUint32(data, math.Float32bits(float32(value)))
+        case "u16":
+            order.PutUint16(data, uint16(clamp(value, 0, math.MaxUint16)))
+        case "s16":
+            order.PutUint16(data, uint16(int16(clamp(value, math.MinInt16, math.MaxInt16))))
+        case "u8":
+            data[0] = uint8(clamp(value, 0, math.MaxUint8))
+        case "s8":
+            data[0] = uint8(int8(clamp(value, math.MinInt8, math.MaxInt8)))
+        case "u64":
+            order.PutUint64(data, uint64(clamp(value, 0, math.MaxUint64)))
+        case "f64":
+            order.PutUint64(data, math.Float64bits(value))
+        case "bool":
+            if value != 0 {
+                data[0] = 1
+            }
+        }
+    }
+
+    return packet
+}
+
+// clamp rounds value to an integer inside [min, max]
+func clamp(value float64, min float64, max float64) float64 {
+    return math.Max(min, math.Min(max, math.Round(value)))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+    "flag"
+    "log"
+    "io"
+    "net"
+    "strconv"
+    "time"
+
+    "jesseboth/fdt/src/game"
+    "jesseboth/fdt/src/sim"
+    "jesseboth/fdt/src/util"
+)
+
+// simulate sends synthetic telemetry for a game so dashboards can be developed without a console
+func simulate(args []string) {
+    flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+    gameSTR := flags.String("game", "FM", "Specify an abbreviated game ie: FM, FH5")
+    host := flags.String("host", "127.0.0.1", "Address to send packets to")
+    portSTR := flags.String("port", "9999", "UDP port number to send to")
+    rate := flags.Int("rate", 60, "Packets per second")
+    trackLength := flags.Float64("track", 3000, "Track length in meters")
+    laps := flags.Int("laps", 0, "Stop after this many laps (0 = run forever)")
+    debugMode := flags.Bool("d", false, "Enables extra debug information if set")
+    flags.Parse(args)
+
+    portSet := false
+    flags.Visit(func(f *flag.Flag) {
+        portSet = portSet || f.Name == "port"
+    })
+
+    if *rate <= 0 || *trackLength <= 0 {
+        log.Fatalf("Error: rate and track length must be positive")
+    }
+
+    format, err := util.LoadFormat(util.FormatFile(*gameSTR), *debugMode)
+    if err != nil {
+        log.Fatalf("Error: %s", err)
+    }
+
+    var conn io.WriteCloser
+    if game.GT7(*gameSTR) {
+        // GT7 only streams to whoever sends the heartbeat, act as the console
+        port, err := strconv.Atoi(*portSTR)
+        if err != nil {
+            log.Fatalf("Error: invalid port %s", *portSTR)
+        }
+        if !portSet {
+            port = game.GT7Port
+        }
+        conn, err = sim.NewConsole(port)
+        if err != nil {
+            log.Fatal(err)
+        }
+        log.Printf("Simulating a GT7 console at %d Hz, waiting for a heartbeat on port %d\n", *rate, game.GT7HeartbeatPort)
+    } else {
+        conn, err = net.Dial("udp", *host+":"+*portSTR)
+        if err != nil {
+            log.Fatal(err)
+        }
+        log.Printf("Simulating %s to %s:%s at %d Hz\n", *gameSTR, *host, *portSTR, *rate)
+    }
+    defer conn.Close()
+
+    car := sim.NewCar(*trackLength)
+    frame := time.Second / time.Duration(*rate)
+    ticker := time.NewTicker(frame)
+    defer ticker.Stop()
+
+    lap := 0
+    for range ticker.C {
+        car.Step(frame.Seconds())
+
+        values := car.Values()
+        sim.Adjust(*gameSTR, values)
+
+        for _, packet := range sim.Packets(values, format) {
+            if _, err := conn.Write(packet); err != nil && *debugMode {
+                // Nothing listening yet is fine, keep driving
+                log.Println("Error sending packet:", err)
+            }
+        }
+
+        if car.Lap() != lap {
+            lap = car.Lap()
+            log.Printf("Lap %d: %.3f", lap, values["LastLap"])
+            if *laps > 0 && lap >= *laps {
+                return
+            }
+        }
+    }
+}
@@ -12,6 +12,19 @@ func Float32frombytes(bytes []byte) float32 {
     return float
 }
 
+// Float32frombytesOrder converts bytes into a float32 using the given byte order
+func Float32frombytesOrder(bytes []byte, order binary.ByteOrder) float32 {
+    return math.Float32frombits(order.Uint32(bytes))
+}
+
+// Float64frombytesOrder converts 8 bytes into a float64 using the given byte order
+func Float64frombytesOrder(b []byte, order binary.ByteOrder) float64 {
+    if len(b) < 8 {
+        return 0
+    }
+    return math.Float64frombits(order.Uint64(b))
+}
+
 // Float64frombytes converts 8 bytes (little-endian) to a float64
 func Float64frombytes(b []byte) float64 {
 	if len(b) < 8 {
@@ -21,3 +34,8 @@ func Float64frombytes(b []byte) float64 {
 		uint64(b[4])<<32 | uint64(b[5])<<40 | uint64(b[6])<<48 | uint64(b[7])<<56
 	return math.Float64frombits(bits)
 }
+
+// CelsiusToFahrenheit converts a temperature, dashes color tires in Fahrenheit
+func CelsiusToFahrenheit(celsius float32) float32 {
+    return celsius*9/5 + 32
+}
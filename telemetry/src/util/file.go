@@ -72,4 +72,20 @@ func ReadLines(path string) ([]string, error) {
         lines = append(lines, scanner.Text())
     }
     return lines, scanner.Err()
-}
\ No newline at end of file
+}
+// AppendFile adds value to the end of the file, creating it and its directory if needed
+func AppendFile(filePath string, value string) error {
+    if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+        return fmt.Errorf("failed to create directory: %w", err)
+    }
+
+    file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+    if err != nil {
+        return fmt.Errorf("failed to open file: %w", err)
+    }
+    if _, err := file.WriteString(value); err != nil {
+        file.Close()
+        return fmt.Errorf("failed to write to file: %w", err)
+    }
+    return file.Close()
+}
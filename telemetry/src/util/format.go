@@ -0,0 +1,471 @@
+package util
+
+import (
+    "bytes"
+    "fmt"
+    "log"
+    "strconv"
+    "strings"
+)
+
+// FormatDir holds the packet format files, relative to the telemetry directory
+const FormatDir = "packets"
+
+// FormatFile returns the packet format file for an abbreviated game id
+func FormatFile(game string) string {
+    return FormatDir + "/" + game + "_packetformat.dat"
+}
+
+// KeyLength is the key of multi packet formats whose packet kinds share no
+// header and are told apart by the datagram length
+const KeyLength = "length"
+
+// Format is a parsed packet format file. Most games send a single layout,
+// others send several packet kinds that share a header and are told apart
+// by a key field in it, or by their length.
+type Format struct {
+    Fields []Telemetry // every field of a single layout, or the header fields
+    Length int         // packet length of a single layout, or the header length
+    Key    string      // header field selecting the packet kind, empty for a single layout
+    Kinds  []PacketKind
+
+    Transforms []Transform // applied in order after decoding
+    Warnings   []string    // lines that were skipped or only partly read
+}
+
+// PacketKind is one packet layout of a multi packet format
+type PacketKind struct {
+    ID     int64
+    Name   string
+    Fields []Telemetry // header and body fields
+    Length int
+}
+
+// Multi reports whether the format has several packet kinds
+func (f *Format) Multi() bool {
+    return f.Key != ""
+}
+
+// Layout returns the fields and required length for a datagram. ok is false
+// when the key field holds a packet kind the format does not describe.
+func (f *Format) Layout(data []byte) ([]Telemetry, int, bool) {
+    if !f.Multi() || len(data) < f.Length {
+        return f.Fields, f.Length, true
+    }
+    if kind := f.Kind(data); kind != nil {
+        return kind.Fields, kind.Length, true
+    }
+    return nil, 0, false
+}
+
+// Kind returns the packet kind of a datagram of a multi packet format, nil if
+// the format does not describe it
+func (f *Format) Kind(data []byte) *PacketKind {
+    id, _ := f.KeyValue(data)
+    if f.Key == KeyLength {
+        // the longest packet kind that fits, trailing optional fields are ignored
+        var match *PacketKind
+        for i := range f.Kinds {
+            if f.Kinds[i].ID <= id && (match == nil || f.Kinds[i].ID > match.ID) {
+                match = &f.Kinds[i]
+            }
+        }
+        return match
+    }
+
+    for i := range f.Kinds {
+        if f.Kinds[i].ID == id {
+            return &f.Kinds[i]
+        }
+    }
+    return nil
+}
+
+// KeyValue reads the packet kind from a datagram of a multi packet format
+func (f *Format) KeyValue(data []byte) (int64, bool) {
+    if f.Key == KeyLength {
+        return int64(len(data)), true
+    }
+    for _, T := range f.Fields {
+        if T.Name == f.Key && len(data) >= T.EndOffset {
+            return T.Integer(data)
+        }
+    }
+    return 0, false
+}
+
+// AllFields returns the fields of every packet kind, header fields first
+func (f *Format) AllFields() []Telemetry {
+    fields := append([]Telemetry(nil), f.Fields...)
+    for _, kind := range f.Kinds {
+        fields = append(fields, kind.Fields[len(f.Fields):]...)
+    }
+    return fields
+}
+
+// assignSlots numbers the values of a format in the order AllFields lists
+// them, fields of different packet kinds with the same name share a slot
+func assignSlots(format *Format) {
+    slots := make(map[string]int)
+    assign := func(fields []Telemetry) {
+        for i := range fields {
+            slot, ok := slots[fields[i].Name]
+            if !ok {
+                slot = len(slots)
+                slots[fields[i].Name] = slot
+            }
+            fields[i].Slot = slot
+        }
+    }
+    assign(format.Fields)
+    for i := range format.Kinds {
+        assign(format.Kinds[i].Fields)
+    }
+}
+
+// LoadFormat reads a packet format file into a Format.
+//
+// Each line holds a type and a name, anything after ';' is a comment:
+//   f32 Speed;              field at the current offset
+//   str64 TrackName;        NUL terminated string in a fixed 64 byte field
+//   @0x94 f32 Speed;        field at an explicit byte offset (decimal or 0x hex)
+//   @148;                   move the current offset without adding a field
+//   pad 12;                 skip bytes
+//   f32[4] TireTemp;        array, expands to TireTemp0 .. TireTemp3
+//   f32[FL,FR,RL,RR] Temp;  array with named elements, expands to TempFL .. TempRR
+//   endian big;             byte order of the following fields (little by default)
+//   f32be Speed;            byte order of a single field, be or le suffix
+//
+// Multi packet formats declare the header fields first, then the key field
+// and one section per packet kind. Section offsets start after the header:
+//   u8 PacketId;
+//   key PacketId;
+//   packet 0 Motion;
+//   f32 PositionX;
+//
+// With "key length;" there is no header, each packet id is the length of
+// the shortest datagram of that kind.
+//
+// Transforms convert values after decoding, in the order they are declared.
+// Converted and derived values are f32:
+//   scale CurrentEngineRpm 10;       multiply
+//   offset LapNumber 1;              add
+//   unit Speed mph m/s;              convert units, see Units
+//   enum Weather WeatherName 0=Clear, 1=Light Cloud;   label a value
+//   derive DistanceLeft = StageLength - Odometer;     + - * / ( ) over values
+func LoadFormat(formatFile string, debug bool) (*Format, error) {
+    format := &Format{}
+    var telemArray []Telemetry
+    var totalLength int
+    var kind *PacketKind
+
+    // Load lines from packet format file
+    lines, err := ReadLines(formatFile)
+    if err != nil {
+        return nil, fmt.Errorf("error reading format file: %w", err)
+    }
+
+    // finish stores the fields read so far in the header or the current packet kind
+    finish := func() {
+        if kind == nil {
+            format.Fields = telemArray
+            format.Length = totalLength
+        } else {
+            kind.Fields = append(append([]Telemetry(nil), format.Fields...), telemArray...)
+            kind.Length = totalLength
+            format.Kinds = append(format.Kinds, *kind)
+        }
+    }
+
+    // Process format file into array of Telemetry structs
+    offset := 0
+    bigEndian := false
+
+    for n, line := range lines {
+        i := n + 1 // line number
+        dataClean := strings.Split(line, ";")
+        dataFormat := strings.Fields(dataClean[0])
+
+        // extra words are ignored, usually a missing ';' before a comment
+        ignore := func(used int) {
+            if len(dataFormat) > used {
+                warning := fmt.Sprintf("ignoring '%s' on line %d in %s", strings.Join(dataFormat[used:], " "), i, formatFile)
+                format.Warnings = append(format.Warnings, warning)
+                if debug {
+                    log.Printf("Warning: %s", warning)
+                }
+            }
+        }
+
+        // explicit offset, optionally followed by a field on the same line
+        if len(dataFormat) > 0 && strings.HasPrefix(dataFormat[0], "@") {
+            position, err := strconv.ParseInt(dataFormat[0][1:], 0, 32)
+            if err != nil || position < 0 {
+                return nil, fmt.Errorf("invalid offset '%s' on line %d in %s", dataFormat[0], i, formatFile)
+            }
+            offset = int(position)
+            dataFormat = dataFormat[1:]
+            if len(dataFormat) == 0 {
+                continue
+            }
+        }
+
+        if len(dataFormat) > 0 && strings.HasPrefix(dataFormat[0], "//") {
+            // make sure line is not a comment
+            if debug {
+                log.Printf("Skipping comment line %d in %s", i, formatFile)
+            }
+            continue
+        } else if len(dataFormat) == 1 {
+            // a type or directive without a name, skip this line
+            warning := fmt.Sprintf("skipping malformed line %d in %s: %s", i, formatFile, strings.TrimSpace(line))
+            format.Warnings = append(format.Warnings, warning)
+            if debug {
+                log.Printf("Warning: %s", warning)
+            }
+            continue
+        } else if len(dataFormat) == 0 {
+            continue
+        }
+
+        switch dataFormat[0] {
+        case "endian":
+            switch dataFormat[1] {
+            case "big":
+                bigEndian = true
+            case "little":
+                bigEndian = false
+            default:
+                return nil, fmt.Errorf("invalid endianness '%s' on line %d in %s", dataFormat[1], i, formatFile)
+            }
+            ignore(2)
+            continue
+
+        case "pad":
+            padding, err := strconv.Atoi(dataFormat[1])
+            if err != nil || padding < 0 {
+                return nil, fmt.Errorf("invalid padding '%s' on line %d in %s", dataFormat[1], i, formatFile)
+            }
+            offset += padding
+            if offset > totalLength {
+                totalLength = offset
+            }
+            ignore(2)
+            continue
+
+        case "key":
+            if kind != nil {
+                return nil, fmt.Errorf("key must be declared before the first packet on line %d in %s", i, formatFile)
+            }
+            format.Key = dataFormat[1]
+            ignore(2)
+            continue
+
+        case "packet":
+            if format.Key == "" {
+                return nil, fmt.Errorf("packet declared without a key on line %d in %s", i, formatFile)
+            }
+            id, err := strconv.ParseInt(dataFormat[1], 0, 64)
+            if err != nil {
+                return nil, fmt.Errorf("invalid packet id '%s' on line %d in %s", dataFormat[1], i, formatFile)
+            }
+
+            finish()
+            kind = &PacketKind{ID: id, Name: dataFormat[1]}
+            if len(dataFormat) > 2 {
+                kind.Name = dataFormat[2]
+            }
+            ignore(3)
+
+            // every packet body starts right after the header
+            telemArray = nil
+            totalLength = format.Length
+            offset = format.Length
+            continue
+
+        case "scale", "offset", "unit", "enum", "derive":
+            transform, err := parseTransform(dataFormat)
+            if err != nil {
+                return nil, fmt.Errorf("%s on line %d in %s", err, i, formatFile)
+            }
+            transform.Position = i
+            format.Transforms = append(format.Transforms, transform)
+            continue
+        }
+
+        dataType, suffixes, err := parseArray(dataFormat[0])
+        if err != nil {
+            return nil, fmt.Errorf("%s on line %d in %s", err, i, formatFile)
+        }
+        dataName := dataFormat[1]
+        ignore(2)
+        dataType, fieldBigEndian := parseEndian(dataType, bigEndian)
+
+        if debug {
+            log.Printf("DataType: %s, DataName: %s", dataType, dataName)
+        }
+
+        dataLength := TypeLength(dataType)
+        if dataLength == 0 {
+            return nil, fmt.Errorf("unknown data type '%s' on line %d in %s", dataType, i, formatFile)
+        }
+
+        for _, suffix := range suffixes {
+            // Compute offsets and append telemetry item
+            startOffset := offset
+            endOffset := offset + dataLength
+            offset = endOffset
+            if endOffset > totalLength {
+                totalLength = endOffset
+            }
+
+            telemItem := Telemetry{
+                Position:    i,
+                Name:        dataName + suffix,
+                DataType:    dataType,
+                StartOffset: startOffset,
+                EndOffset:   endOffset,
+                BigEndian:   fieldBigEndian,
+                Type:        CompileType(dataType),
+            }
+            telemArray = append(telemArray, telemItem)
+
+            if debug {
+                log.Printf("Processed %s line %d: %s (%s),  Byte offset: %d:%d \n",
+                    formatFile, i, telemItem.Name, dataType, startOffset, endOffset)
+            }
+        }
+    }
+    finish()
+    assignSlots(format)
+
+    // transforms read fields or values derived before them
+    known := make(map[string]bool)
+    for _, T := range format.AllFields() {
+        known[T.Name] = true
+    }
+    for _, transform := range format.Transforms {
+        for _, name := range transform.Inputs() {
+            if !known[name] {
+                return nil, fmt.Errorf("unknown value %s in %s on line %d in %s", name, transform.Kind, transform.Position, formatFile)
+            }
+        }
+        known[transform.Name] = true
+    }
+
+    if format.Multi() {
+        if len(format.Kinds) == 0 {
+            return nil, fmt.Errorf("key %s declared without any packet in %s", format.Key, formatFile)
+        }
+        if format.Key == KeyLength {
+            for _, kind := range format.Kinds {
+                if int64(kind.Length) > kind.ID {
+                    return nil, fmt.Errorf("packet %s is longer than its length %d in %s", kind.Name, kind.ID, formatFile)
+                }
+            }
+            return format, nil
+        }
+        found := false
+        for _, T := range format.Fields {
+            if T.Name == format.Key {
+                found = true
+                if !T.IsInteger() {
+                    return nil, fmt.Errorf("key %s must be an integer field in %s", format.Key, formatFile)
+                }
+            }
+        }
+        if !found {
+            return nil, fmt.Errorf("key %s is not a header field in %s", format.Key, formatFile)
+        }
+    }
+
+    return format, nil
+}
+
+// parseArray splits "f32[4]" or "f32[FL,FR]" into the element type and the name
+// suffix of every element. Plain types return a single empty suffix.
+func parseArray(token string) (string, []string, error) {
+    open := strings.Index(token, "[")
+    if open < 0 {
+        return token, []string{""}, nil
+    }
+    if !strings.HasSuffix(token, "]") {
+        return "", nil, fmt.Errorf("malformed array type '%s'", token)
+    }
+
+    dataType := token[:open]
+    inner := token[open+1 : len(token)-1]
+
+    if count, err := strconv.Atoi(inner); err == nil {
+        if count <= 0 {
+            return "", nil, fmt.Errorf("invalid array length in '%s'", token)
+        }
+        suffixes := make([]string, count)
+        for i := range suffixes {
+            suffixes[i] = strconv.Itoa(i)
+        }
+        return dataType, suffixes, nil
+    }
+
+    suffixes := strings.Split(inner, ",")
+    for i, suffix := range suffixes {
+        suffixes[i] = strings.TrimSpace(suffix)
+        if suffixes[i] == "" {
+            return "", nil, fmt.Errorf("empty array element name in '%s'", token)
+        }
+    }
+    return dataType, suffixes, nil
+}
+
+// parseEndian strips a be/le suffix from a type, falling back to the current default
+func parseEndian(dataType string, bigEndian bool) (string, bool) {
+    if TypeLength(dataType) != 0 {
+        return dataType, bigEndian
+    }
+    if strings.HasSuffix(dataType, "be") && TypeLength(strings.TrimSuffix(dataType, "be")) != 0 {
+        return strings.TrimSuffix(dataType, "be"), true
+    }
+    if strings.HasSuffix(dataType, "le") && TypeLength(strings.TrimSuffix(dataType, "le")) != 0 {
+        return strings.TrimSuffix(dataType, "le"), false
+    }
+    return dataType, bigEndian
+}
+
+// TypeLength returns the size in bytes of a format data type, 0 if unknown
+func TypeLength(dataType string) int {
+    switch dataType {
+    case "s32", "u32", "f32":
+        return 4
+    case "u16", "s16":
+        return 2
+    case "u8", "s8", "bool":
+        return 1
+    case "u64", "f64":
+        return 8
+    case "hzn":
+        return 12
+    default:
+        return StringLength(dataType)
+    }
+}
+
+// StringLength returns the size of a fixed length string type such as
+// str64, 0 if dataType is not a string
+func StringLength(dataType string) int {
+    if !strings.HasPrefix(dataType, "str") {
+        return 0
+    }
+    length, err := strconv.Atoi(dataType[3:])
+    if err != nil || length <= 0 {
+        return 0
+    }
+    return length
+}
+
+// CString reads a NUL terminated string from a fixed length field
+func CString(chunk []byte) string {
+    if i := bytes.IndexByte(chunk, 0); i >= 0 {
+        chunk = chunk[:i]
+    }
+    return strings.TrimSpace(string(chunk))
+}
@@ -0,0 +1,236 @@
+package util
+
+import (
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// The last datagram received, served with every byte range labelled by the
+// packet format so shifted fields are easy to spot
+var raw = struct {
+    sync.Mutex
+    last   rawDatagram
+    kinds  map[int64]*rawDatagram // last datagram of every packet kind of multi packet formats
+    format *Format
+}{kinds: make(map[int64]*rawDatagram)}
+
+type rawDatagram struct {
+    data     []byte
+    received time.Time
+}
+
+const rawBytesPerLine = 16
+
+// SetRaw keeps a copy of the last datagram and the format it is decoded with,
+// format is nil while the game is unknown
+func SetRaw(data []byte, format *Format) {
+    raw.Lock()
+    defer raw.Unlock()
+    now := time.Now()
+    raw.last.data = append(raw.last.data[:0], data...)
+    raw.last.received = now
+
+    if format != raw.format {
+        raw.format = format
+        raw.kinds = make(map[int64]*rawDatagram)
+    }
+    if format != nil && format.Multi() && len(data) >= format.Length {
+        id, _ := format.KeyValue(data)
+        kind, ok := raw.kinds[id]
+        if !ok {
+            kind = &rawDatagram{}
+            raw.kinds[id] = kind
+        }
+        kind.data = append(kind.data[:0], data...)
+        kind.received = now
+    }
+}
+
+// RawRange is a labelled byte range of a datagram
+type RawRange struct {
+    Offset int         `json:"offset"`
+    End    int         `json:"end"`
+    Name   string      `json:"name"` // field name, empty for bytes the format skips or does not cover
+    Type   string      `json:"type,omitempty"`
+    Line   int         `json:"line,omitempty"` // line in the format file
+    Hex    string      `json:"hex"`
+    Value  interface{} `json:"value,omitempty"`
+
+    bytes []byte
+}
+
+// RawPacket is the annotated view of a datagram
+type RawPacket struct {
+    Game   string     `json:"game"`
+    Length int        `json:"length"`         // bytes received
+    Age    float64    `json:"age"`            // seconds since it was received
+    Kind   string     `json:"kind,omitempty"` // packet kind of multi packet formats
+    Layout int        `json:"layout"`         // bytes described by the format
+    Known  bool       `json:"known"`          // the format describes this datagram
+    Ranges []RawRange `json:"ranges"`
+}
+
+// Annotate labels every byte of data with the field of the format covering it.
+// Bytes between fields are padding, bytes after the layout are not covered.
+func Annotate(data []byte, format *Format) RawPacket {
+    packet := RawPacket{Length: len(data)}
+
+    var fields []Telemetry
+    if format != nil {
+        fields, packet.Layout, packet.Known = format.Layout(data)
+        if format.Multi() && len(data) >= format.Length {
+            if kind := format.Kind(data); kind != nil {
+                packet.Kind = fmt.Sprintf("%d %s", kind.ID, kind.Name)
+            } else {
+                id, _ := format.KeyValue(data)
+                packet.Kind = fmt.Sprintf("%d unknown", id)
+            }
+        }
+    }
+
+    // explicit offsets may place fields out of order or on top of each other
+    fields = append([]Telemetry(nil), fields...)
+    sort.SliceStable(fields, func(i, j int) bool {
+        return fields[i].StartOffset < fields[j].StartOffset
+    })
+
+    covered := 0
+    for _, T := range fields {
+        if T.EndOffset > len(data) {
+            // datagram too short for the layout
+            break
+        }
+        if T.StartOffset > covered {
+            packet.Ranges = append(packet.Ranges, rawRange(data, covered, T.StartOffset, "pad"))
+        }
+        packet.Ranges = append(packet.Ranges, RawRange{
+            Offset: T.StartOffset,
+            End:    T.EndOffset,
+            Name:   T.Name,
+            Type:   T.DataType,
+            Line:   T.Position,
+            Hex:    hex.EncodeToString(data[T.StartOffset:T.EndOffset]),
+            Value:  T.Value(data),
+            bytes:  data[T.StartOffset:T.EndOffset],
+        })
+        if T.EndOffset > covered {
+            covered = T.EndOffset
+        }
+    }
+    if end := packet.Layout; covered < end && end <= len(data) {
+        packet.Ranges = append(packet.Ranges, rawRange(data, covered, end, "pad"))
+        covered = end
+    }
+    if covered < len(data) {
+        packet.Ranges = append(packet.Ranges, rawRange(data, covered, len(data), "trailing"))
+    }
+    return packet
+}
+
+func rawRange(data []byte, start int, end int, what string) RawRange {
+    return RawRange{Offset: start, End: end, Type: what, Hex: hex.EncodeToString(data[start:end]), bytes: data[start:end]}
+}
+
+// String renders the packet as a hex dump, one field per line
+func (p RawPacket) String() string {
+    var b strings.Builder
+    fmt.Fprintf(&b, "%s, %d bytes received %.3fs ago", p.Game, p.Length, p.Age)
+    if p.Kind != "" {
+        fmt.Fprintf(&b, ", packet %s", p.Kind)
+    }
+    if p.Known {
+        fmt.Fprintf(&b, ", format describes %d bytes\n\n", p.Layout)
+    } else {
+        fmt.Fprintf(&b, ", not described by the format\n\n")
+    }
+
+    fmt.Fprintf(&b, "%6s  %-*s  %-8s %-5s %-28s %s\n", "offset", rawBytesPerLine*3-1, "bytes", "type", "line", "name", "value")
+    for _, r := range p.Ranges {
+        for start := 0; start < len(r.bytes) || start == 0; start += rawBytesPerLine {
+            end := start + rawBytesPerLine
+            if end > len(r.bytes) {
+                end = len(r.bytes)
+            }
+            words := make([]string, 0, rawBytesPerLine)
+            for _, c := range r.bytes[start:end] {
+                words = append(words, fmt.Sprintf("%02x", c))
+            }
+
+            if start > 0 {
+                // continuation of a long field
+                fmt.Fprintf(&b, "%6d  %s\n", r.Offset+start, strings.Join(words, " "))
+                continue
+            }
+
+            name, value, line := r.Name, "", ""
+            if r.Name == "" {
+                name = "(" + r.Type + ")"
+            } else {
+                value = fmt.Sprint(r.Value)
+                line = fmt.Sprint(r.Line)
+                if s, ok := r.Value.(string); ok {
+                    value = fmt.Sprintf("%q", s)
+                }
+            }
+            fmt.Fprintf(&b, "%6d  %-*s  %-8s %-5s %-28s %s\n", r.Offset, rawBytesPerLine*3-1, strings.Join(words, " "), r.Type, line, name, value)
+        }
+    }
+    return b.String()
+}
+
+// rawResponder serves the last datagram as a hex dump, or as JSON with
+// ?format=json. ?kind=ID picks the last datagram of one packet kind.
+func rawResponder(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case "GET":
+        EnableCors(&w)
+
+        var id int64
+        kind := r.URL.Query().Get("kind")
+        if kind != "" {
+            var err error
+            if id, err = strconv.ParseInt(kind, 0, 64); err != nil {
+                http.Error(w, "invalid packet kind "+kind, http.StatusBadRequest)
+                return
+            }
+        }
+
+        raw.Lock()
+        datagram := &raw.last
+        if kind != "" {
+            datagram = raw.kinds[id]
+        }
+        if datagram == nil || datagram.received.IsZero() {
+            raw.Unlock()
+            http.Error(w, "no datagram received yet", http.StatusNotFound)
+            return
+        }
+        // the ranges point into the datagram, the buffer is reused for the next one
+        data := append([]byte(nil), datagram.data...)
+        format, age := raw.format, time.Since(datagram.received)
+        raw.Unlock()
+
+        packet := Annotate(data, format)
+        packet.Age = age.Seconds()
+        packet.Game = GetStatus().Game
+
+        if r.URL.Query().Get("format") == "json" {
+            w.Header().Set("Content-Type", "application/json")
+            json.NewEncoder(w).Encode(packet)
+            return
+        }
+        w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+        w.Write([]byte(packet.String()))
+    default:
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        log.Printf("Not supported.")
+    }
+}
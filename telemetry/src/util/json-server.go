@@ -1,6 +1,7 @@
 package util
 
 import (
+    "context"
     "log"
     "net"
     "net/http"
@@ -10,39 +11,77 @@ import (
 
 var (
         mu          sync.Mutex
-        jsonData    string
+        jsonData    []byte // copied into for every packet
         lastUpdated time.Time
         staleTime   = 5 * time.Second // mark stale if no update in 5s
 )
 
 const jsonServerPort = ":8888"
 
+var jsonServer = &http.Server{Addr: jsonServerPort}
+
 func responder(w http.ResponseWriter, r *http.Request) {
     switch r.Method {
     case "GET":
-        enableCors(&w)
-
-        mu.Lock()
-        data := jsonData
-        age := time.Since(lastUpdated)
-        mu.Unlock()
+        EnableCors(&w)
 
-        if age > staleTime || data == "" {
-            data = "null" // or "{}" if you prefer empty JSON
+        // ?fields=Speed,Gear only sends those, every Nth frame counts do not apply to a single frame
+        subscription, err := ParseFields(r.URL.Query().Get("fields"))
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
         }
-
-        w.Write([]byte(data))
+        w.Write([]byte(subscription.Project(currentJson())))
     default:
         w.WriteHeader(http.StatusMethodNotAllowed)
         log.Printf("Not supported.")
     }
 }
 
+// currentJson returns the latest telemetry, or null if it is missing or stale
+func currentJson() string {
+    mu.Lock()
+    defer mu.Unlock()
+
+    if time.Since(lastUpdated) > staleTime || len(jsonData) == 0 {
+        return "null" // or "{}" if you prefer empty JSON
+    }
+    return string(jsonData)
+}
+
+// watchStale tells websocket clients once the telemetry has gone stale
+func watchStale() {
+    stale := false
+    for range time.Tick(time.Second) {
+        data := currentJson()
+        if data == "null" && !stale {
+            publish()
+        }
+        stale = data == "null"
+    }
+}
+
 func ServeJson() {
     http.HandleFunc("/telemetry", responder)
+    http.HandleFunc("/stream", streamResponder)
+    http.HandleFunc("/status", statusResponder)
+    http.HandleFunc("/schema", schemaResponder)
+    http.HandleFunc("/raw", rawResponder)
+
+    go watchStale()
 
     log.Printf("JSON data at http://%s%s\n", GetOutboundIP(), jsonServerPort)
-    log.Fatal(http.ListenAndServe(jsonServerPort, nil))
+    if err := jsonServer.ListenAndServe(); err != http.ErrServerClosed {
+        log.Fatal(err)
+    }
+}
+
+// StopJson stops the JSON server, open requests are given until ctx is done.
+// Websocket streams are closed.
+func StopJson(ctx context.Context) error {
+    err := jsonServer.Shutdown(ctx)
+    closeWebsockets()
+    return err
 }
 
 // GetOutboundIP finds preferred outbound IP of this machine
@@ -57,15 +96,19 @@ func GetOutboundIP() net.IP {
     return localAddr.IP
 }
 
-// SetJson updates the telemetry JSON and timestamps it
-func SetJson(str string) {
+// SetJson updates the telemetry JSON and timestamps it, data is copied so
+// the caller can reuse it. Empty data clears the telemetry.
+func SetJson(data []byte) {
     mu.Lock()
-    defer mu.Unlock()
-    jsonData = str
+    jsonData = append(jsonData[:0], data...)
     lastUpdated = time.Now()
+    mu.Unlock()
+
+    publish()
 }
 
-func enableCors(w *http.ResponseWriter) {
+// EnableCors lets dashboards served from another origin read the response
+func EnableCors(w *http.ResponseWriter) {
     (*w).Header().Set("Access-Control-Allow-Origin", "*")
 }
 
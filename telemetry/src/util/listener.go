@@ -0,0 +1,252 @@
+package util
+
+import (
+    "errors"
+    "log"
+    "net"
+    "os"
+    "sync"
+    "syscall"
+    "time"
+)
+
+// Retry delays after read errors, doubled on every error in a row
+const (
+    listenerMinBackoff = 100 * time.Millisecond
+    listenerMaxBackoff = 5 * time.Second
+)
+
+// UDPConn is the part of a UDP socket the game connections use, a Listener
+// can be bound again underneath them
+type UDPConn interface {
+    PacketReader
+    WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+    SetReadDeadline(t time.Time) error
+}
+
+// udpSocket is a bound socket the Listener reads from
+type udpSocket interface {
+    UDPConn
+    Close() error
+}
+
+// Listener is a UDP socket that survives read errors. Errors that pass, like
+// ICMP port unreachable or a network going down, are retried with backoff, a
+// socket that broke is closed and bound again. Reads only fail on deadlines
+// and once the listener is closed, the degraded state is shown on /status.
+type Listener struct {
+    addr   *net.UDPAddr
+    listen func(addr *net.UDPAddr) (udpSocket, error)
+
+    mu       sync.Mutex
+    conn     udpSocket // nil until it is bound again
+    deadline time.Time
+    closed   bool
+    done     chan struct{}
+
+    degraded bool // only touched by the reading goroutine
+}
+
+// Listen binds a UDP socket to address, ie: "0.0.0.0:9999"
+func Listen(address string) (*Listener, error) {
+    addr, err := net.ResolveUDPAddr("udp4", address)
+    if err != nil {
+        return nil, err
+    }
+    conn, err := listenUDP(addr)
+    if err != nil {
+        return nil, err
+    }
+    return &Listener{addr: addr, listen: listenUDP, conn: conn, done: make(chan struct{})}, nil
+}
+
+func listenUDP(addr *net.UDPAddr) (udpSocket, error) {
+    conn, err := net.ListenUDP("udp", addr)
+    if err != nil {
+        return nil, err
+    }
+    return conn, nil
+}
+
+// ReadFromUDP returns the next datagram, retrying until one arrives
+func (l *Listener) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+    var backoff time.Duration
+    for {
+        l.mu.Lock()
+        conn, closed := l.conn, l.closed
+        l.mu.Unlock()
+        if closed {
+            return 0, nil, net.ErrClosed
+        }
+
+        if conn == nil {
+            if err := l.wait(backoff); err != nil {
+                return 0, nil, err
+            }
+            backoff = nextBackoff(backoff)
+            l.bind()
+            continue
+        }
+
+        n, addr, err := conn.ReadFromUDP(b)
+        if err == nil {
+            if l.degraded {
+                l.degraded = false
+                log.Printf("Receiving on %s again", l.addr)
+                SetReadRecovered()
+            }
+            return n, addr, nil
+        }
+
+        var netErr net.Error
+        if l.isClosed() {
+            return 0, nil, net.ErrClosed
+        } else if errors.As(err, &netErr) && netErr.Timeout() {
+            return n, addr, err
+        }
+
+        l.degraded = true
+        if transientReadError(err) {
+            log.Printf("Error reading UDP data on %s, retrying: %v", l.addr, err)
+            SetReadError(err)
+        } else {
+            log.Printf("Error reading UDP data on %s, binding the socket again: %v", l.addr, err)
+            SetReadError(err)
+            l.drop(conn)
+        }
+
+        if err := l.wait(backoff); err != nil {
+            return 0, nil, err
+        }
+        backoff = nextBackoff(backoff)
+    }
+}
+
+// transientReadError tells errors that pass on their own from a socket that broke
+func transientReadError(err error) bool {
+    var errno syscall.Errno
+    if !errors.As(err, &errno) {
+        // the socket was closed underneath us, or something unknown went wrong with it
+        return false
+    }
+    switch errno {
+    case syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.EHOSTUNREACH, syscall.ENETUNREACH,
+        syscall.ENETDOWN, syscall.ENOBUFS, syscall.ENOMEM, syscall.EINTR, syscall.EAGAIN:
+        return true
+    }
+    return false
+}
+
+// nextBackoff retries the first error right away, then waits longer every time
+func nextBackoff(backoff time.Duration) time.Duration {
+    switch {
+    case backoff == 0:
+        return listenerMinBackoff
+    case backoff*2 > listenerMaxBackoff:
+        return listenerMaxBackoff
+    default:
+        return backoff * 2
+    }
+}
+
+// wait sleeps before the next retry, it returns early with a timeout when the
+// read deadline passes and with net.ErrClosed when the listener is closed
+func (l *Listener) wait(backoff time.Duration) error {
+    l.mu.Lock()
+    deadline := l.deadline
+    l.mu.Unlock()
+
+    var err error
+    if !deadline.IsZero() && time.Until(deadline) < backoff {
+        backoff = time.Until(deadline)
+        err = os.ErrDeadlineExceeded
+    }
+    if backoff <= 0 {
+        return err
+    }
+
+    timer := time.NewTimer(backoff)
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+        return err
+    case <-l.done:
+        return net.ErrClosed
+    }
+}
+
+// drop closes a broken socket, the next read binds a new one
+func (l *Listener) drop(conn udpSocket) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.conn == conn {
+        l.conn = nil
+    }
+    conn.Close()
+}
+
+// bind opens the socket again, it fails while the address is gone
+func (l *Listener) bind() {
+    conn, err := l.listen(l.addr)
+    if err != nil {
+        log.Printf("Error binding %s again: %v", l.addr, err)
+        SetReadError(err)
+        return
+    }
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.closed {
+        conn.Close()
+        return
+    }
+    if !l.deadline.IsZero() {
+        conn.SetReadDeadline(l.deadline)
+    }
+    l.conn = conn
+    log.Printf("Bound %s again", l.addr)
+    SetRebound()
+}
+
+func (l *Listener) isClosed() bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.closed
+}
+
+// WriteToUDP sends from the listening socket, it fails while the socket is being bound again
+func (l *Listener) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+    l.mu.Lock()
+    conn := l.conn
+    l.mu.Unlock()
+    if conn == nil {
+        return 0, errors.New("socket is being bound again")
+    }
+    return conn.WriteToUDP(b, addr)
+}
+
+// SetReadDeadline applies to the current socket and to any socket bound later
+func (l *Listener) SetReadDeadline(t time.Time) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.deadline = t
+    if l.conn == nil {
+        return nil
+    }
+    return l.conn.SetReadDeadline(t)
+}
+
+// Close stops reading, a blocked read returns net.ErrClosed
+func (l *Listener) Close() error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.closed {
+        return nil
+    }
+    l.closed = true
+    close(l.done)
+    if l.conn == nil {
+        return nil
+    }
+    return l.conn.Close()
+}
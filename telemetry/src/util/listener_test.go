@@ -0,0 +1,184 @@
+package util
+
+import (
+    "encoding/json"
+    "errors"
+    "net"
+    "net/http/httptest"
+    "os"
+    "sync"
+    "syscall"
+    "testing"
+    "time"
+)
+
+type fakeRead struct {
+    data []byte
+    err  error
+}
+
+// fakeSocket hands out its reads in order, then blocks until closed
+type fakeSocket struct {
+    reads  chan fakeRead
+    closed chan struct{}
+    once   sync.Once
+
+    mu    sync.Mutex
+    times []time.Time // of every read
+}
+
+func newFakeSocket(reads ...fakeRead) *fakeSocket {
+    s := &fakeSocket{reads: make(chan fakeRead, len(reads)), closed: make(chan struct{})}
+    for _, r := range reads {
+        s.reads <- r
+    }
+    return s
+}
+
+func (s *fakeSocket) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+    s.mu.Lock()
+    s.times = append(s.times, time.Now())
+    s.mu.Unlock()
+    select {
+    case r := <-s.reads:
+        return copy(b, r.data), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9999}, r.err
+    case <-s.closed:
+        return 0, nil, net.ErrClosed
+    }
+}
+
+func (s *fakeSocket) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+    return len(b), nil
+}
+
+func (s *fakeSocket) SetReadDeadline(t time.Time) error {
+    return nil
+}
+
+func (s *fakeSocket) Close() error {
+    s.once.Do(func() { close(s.closed) })
+    return nil
+}
+
+// readError is what a UDP read fails with for errno
+func readError(errno syscall.Errno) error {
+    return &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", errno)}
+}
+
+// statusOf reads /status
+func statusOf(t *testing.T) Status {
+    t.Helper()
+    w := httptest.NewRecorder()
+    statusResponder(w, httptest.NewRequest("GET", "/status", nil))
+    var s Status
+    if err := json.NewDecoder(w.Body).Decode(&s); err != nil {
+        t.Fatal(err)
+    }
+    return s
+}
+
+func TestListenerRebind(t *testing.T) {
+    before := GetStatus()
+
+    broken := newFakeSocket(
+        fakeRead{err: readError(syscall.ECONNREFUSED)},
+        fakeRead{err: readError(syscall.ENETUNREACH)},
+        fakeRead{err: errors.New("socket broke")},
+    )
+    bound := newFakeSocket(fakeRead{data: []byte("data")})
+
+    var binds []time.Time
+    var degraded Status
+    l := &Listener{addr: &net.UDPAddr{Port: 9999}, conn: broken, done: make(chan struct{})}
+    l.listen = func(addr *net.UDPAddr) (udpSocket, error) {
+        binds = append(binds, time.Now())
+        if len(binds) == 1 {
+            degraded = statusOf(t)
+            return nil, readError(syscall.EADDRNOTAVAIL)
+        }
+        return bound, nil
+    }
+    defer l.Close()
+
+    b := make([]byte, 1500)
+    n, _, err := l.ReadFromUDP(b)
+    if err != nil || string(b[:n]) != "data" {
+        t.Fatalf("read %q, %v", b[:n], err)
+    }
+
+    select {
+    case <-broken.closed:
+    default:
+        t.Error("broken socket was not closed")
+    }
+    if len(broken.times) != 3 || len(binds) != 2 {
+        t.Fatalf("%d reads and %d binds, want 3 and 2", len(broken.times), len(binds))
+    }
+
+    // the first error is retried right away, then every wait doubles
+    gaps := []struct {
+        from, to time.Time
+        want     time.Duration
+    }{
+        {broken.times[1], broken.times[2], listenerMinBackoff},
+        {broken.times[2], binds[0], 2*listenerMinBackoff + 4*listenerMinBackoff},
+        {binds[0], binds[1], 8 * listenerMinBackoff},
+    }
+    for i, gap := range gaps {
+        if got := gap.to.Sub(gap.from); got < gap.want || got > gap.want+2*listenerMinBackoff {
+            t.Errorf("wait %d took %v, want %v", i, got, gap.want)
+        }
+    }
+
+    if !degraded.Degraded || degraded.ReadErrors != before.ReadErrors+3 || degraded.ReadError != "socket broke" {
+        t.Errorf("/status while binding again: %+v", degraded)
+    }
+    after := statusOf(t)
+    if after.Degraded || after.Rebinds != before.Rebinds+1 || after.ReadErrors != before.ReadErrors+4 {
+        t.Errorf("/status after binding again: %+v, %d rebinds and %d errors before", after, before.Rebinds, before.ReadErrors)
+    }
+}
+
+func TestListenerCloseWhileRetrying(t *testing.T) {
+    l := &Listener{
+        addr: &net.UDPAddr{Port: 9999},
+        listen: func(addr *net.UDPAddr) (udpSocket, error) {
+            return nil, readError(syscall.EADDRNOTAVAIL)
+        },
+        conn: newFakeSocket(fakeRead{err: errors.New("socket broke")}),
+        done: make(chan struct{}),
+    }
+
+    read := make(chan error, 1)
+    go func() {
+        _, _, err := l.ReadFromUDP(make([]byte, 1500))
+        read <- err
+    }()
+    time.Sleep(2 * listenerMinBackoff)
+    l.Close()
+
+    select {
+    case err := <-read:
+        if !errors.Is(err, net.ErrClosed) {
+            t.Errorf("closed listener returned %v, want net.ErrClosed", err)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("Close did not interrupt the retry")
+    }
+}
+
+func TestListenerDeadline(t *testing.T) {
+    l := &Listener{
+        addr: &net.UDPAddr{Port: 9999},
+        conn: newFakeSocket(fakeRead{err: readError(syscall.ECONNREFUSED)}, fakeRead{err: readError(syscall.ECONNREFUSED)}),
+        done: make(chan struct{}),
+    }
+    defer l.Close()
+
+    // a deadline before the next retry ends the read
+    l.SetReadDeadline(time.Now().Add(listenerMinBackoff / 2))
+    _, _, err := l.ReadFromUDP(make([]byte, 1500))
+    if !errors.Is(err, os.ErrDeadlineExceeded) {
+        t.Errorf("read returned %v, want the deadline", err)
+    }
+}
@@ -0,0 +1,83 @@
+package util
+
+import (
+    "net"
+    "sync"
+)
+
+const mergedQueue = 16
+
+// MergedReader reads datagrams from several sources at once, for games that
+// send separate streams to separate ports
+type MergedReader struct {
+    packets chan mergedPacket
+    free    chan []byte // buffers the readers fill, handed back once copied out
+    done    chan struct{}
+    once    sync.Once
+}
+
+type mergedPacket struct {
+    data []byte
+    addr *net.UDPAddr
+    err  error
+}
+
+// NewMergedReader starts reading every source in the background
+func NewMergedReader(sources ...PacketReader) *MergedReader {
+    m := &MergedReader{
+        packets: make(chan mergedPacket, mergedQueue),
+        free:    make(chan []byte, mergedQueue+len(sources)),
+        done:    make(chan struct{}),
+    }
+    for i := 0; i < cap(m.free); i++ {
+        m.free <- make([]byte, 1500)
+    }
+    for _, source := range sources {
+        go m.read(source)
+    }
+    return m
+}
+
+func (m *MergedReader) read(source PacketReader) {
+    for {
+        var buffer []byte
+        select {
+        case buffer = <-m.free:
+        case <-m.done:
+            return
+        }
+        n, addr, err := source.ReadFromUDP(buffer)
+        select {
+        case m.packets <- mergedPacket{data: buffer[:n], addr: addr, err: err}:
+        case <-m.done:
+            return
+        }
+        if err != nil {
+            return
+        }
+    }
+}
+
+// ReadFromUDP returns the next datagram from any of the sources
+func (m *MergedReader) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+    // queued datagrams are dropped once closed
+    select {
+    case <-m.done:
+        return 0, nil, net.ErrClosed
+    default:
+    }
+    select {
+    case p := <-m.packets:
+        n := copy(b, p.data)
+        m.free <- p.data[:cap(p.data)]
+        return n, p.addr, p.err
+    case <-m.done:
+        return 0, nil, net.ErrClosed
+    }
+}
+
+// Close lets the background readers exit, the sources are closed by their owner
+func (m *MergedReader) Close() error {
+    m.once.Do(func() { close(m.done) })
+    return nil
+}
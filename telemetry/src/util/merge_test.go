@@ -0,0 +1,59 @@
+package util
+
+import (
+    "errors"
+    "net"
+    "runtime"
+    "strconv"
+    "testing"
+    "time"
+)
+
+// endlessSource hands out numbered datagrams from one port as fast as they are read
+type endlessSource struct {
+    port int
+    next int
+}
+
+func (s *endlessSource) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+    s.next++
+    return copy(b, strconv.Itoa(s.next)), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: s.port}, nil
+}
+
+func TestMergedReader(t *testing.T) {
+    before := runtime.NumGoroutine()
+    m := NewMergedReader(&endlessSource{port: 4123}, &endlessSource{port: 4124})
+
+    // more datagrams than there are buffers, each source in order
+    last := map[int]int{}
+    b := make([]byte, 1500)
+    deadline := time.Now().Add(time.Second)
+    for i := 0; i < 10*mergedQueue || len(last) < 2; i++ {
+        if time.Now().After(deadline) {
+            t.Fatalf("read from %d sources, want 2", len(last))
+        }
+        n, addr, err := m.ReadFromUDP(b)
+        if err != nil {
+            t.Fatal(err)
+        }
+        number, _ := strconv.Atoi(string(b[:n]))
+        if number != last[addr.Port]+1 {
+            t.Fatalf("datagram %d from port %d after %d", number, addr.Port, last[addr.Port])
+        }
+        last[addr.Port] = number
+    }
+
+    m.Close()
+    if _, _, err := m.ReadFromUDP(b); !errors.Is(err, net.ErrClosed) {
+        t.Errorf("closed reader returned %v, want net.ErrClosed", err)
+    }
+
+    // the readers were blocked handing over datagrams nobody reads
+    deadline = time.Now().Add(time.Second)
+    for runtime.NumGoroutine() > before {
+        if time.Now().After(deadline) {
+            t.Fatalf("%d goroutines left running after Close", runtime.NumGoroutine()-before)
+        }
+        time.Sleep(time.Millisecond)
+    }
+}
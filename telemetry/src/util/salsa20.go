@@ -0,0 +1,73 @@
+package util
+
+import (
+    "encoding/binary"
+    "math/bits"
+)
+
+// Salsa20 constants for 32 byte keys, "expand 32-byte k"
+var salsaSigma = [4]uint32{0x61707865, 0x3320646e, 0x79622d32, 0x6b206574}
+
+// Salsa20XOR xors in with the Salsa20/20 key stream for key and an 8 byte
+// nonce, writing the result to out. The block counter starts at zero, out
+// and in may be the same slice.
+func Salsa20XOR(out []byte, in []byte, nonce []byte, key *[32]byte) {
+    var input [16]byte
+    copy(input[:8], nonce)
+
+    var block [64]byte
+    var counter uint64
+    for len(in) > 0 {
+        binary.LittleEndian.PutUint64(input[8:], counter)
+        salsa20Block(&block, &input, key)
+
+        n := len(in)
+        if n > len(block) {
+            n = len(block)
+        }
+        for i := 0; i < n; i++ {
+            out[i] = in[i] ^ block[i]
+        }
+        out, in = out[n:], in[n:]
+        counter++
+    }
+}
+
+// salsa20Block computes one 64 byte block of key stream for the nonce and counter in input
+func salsa20Block(out *[64]byte, input *[16]byte, key *[32]byte) {
+    var x [16]uint32
+    x[0] = salsaSigma[0]
+    x[5] = salsaSigma[1]
+    x[10] = salsaSigma[2]
+    x[15] = salsaSigma[3]
+    for i := 0; i < 4; i++ {
+        x[1+i] = binary.LittleEndian.Uint32(key[4*i:])
+        x[11+i] = binary.LittleEndian.Uint32(key[16+4*i:])
+        x[6+i] = binary.LittleEndian.Uint32(input[4*i:])
+    }
+
+    s := x
+    for i := 0; i < 20; i += 2 {
+        // column round
+        salsaQuarter(&s, 0, 4, 8, 12)
+        salsaQuarter(&s, 5, 9, 13, 1)
+        salsaQuarter(&s, 10, 14, 2, 6)
+        salsaQuarter(&s, 15, 3, 7, 11)
+        // row round
+        salsaQuarter(&s, 0, 1, 2, 3)
+        salsaQuarter(&s, 5, 6, 7, 4)
+        salsaQuarter(&s, 10, 11, 8, 9)
+        salsaQuarter(&s, 15, 12, 13, 14)
+    }
+
+    for i := range s {
+        binary.LittleEndian.PutUint32(out[4*i:], s[i]+x[i])
+    }
+}
+
+func salsaQuarter(s *[16]uint32, a int, b int, c int, d int) {
+    s[b] ^= bits.RotateLeft32(s[a]+s[d], 7)
+    s[c] ^= bits.RotateLeft32(s[b]+s[a], 9)
+    s[d] ^= bits.RotateLeft32(s[c]+s[b], 13)
+    s[a] ^= bits.RotateLeft32(s[d]+s[c], 18)
+}
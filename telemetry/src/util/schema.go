@@ -0,0 +1,51 @@
+package util
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+    "sync"
+)
+
+var (
+        schemaMu      sync.Mutex
+        schemaData    = []byte("null")
+        schemaVersion int // counts schema changes, stream clients drop their values when it changes
+)
+
+// SetSchema publishes the values of the active game, nil while no game is decoded
+func SetSchema(schema interface{}) {
+    data, err := json.Marshal(schema)
+    if err != nil {
+        log.Printf("Error marshalling schema: %v", err)
+        data = []byte("null")
+    }
+
+    schemaMu.Lock()
+    defer schemaMu.Unlock()
+    schemaData = data
+    schemaVersion++
+}
+
+func currentSchemaVersion() int {
+    schemaMu.Lock()
+    defer schemaMu.Unlock()
+    return schemaVersion
+}
+
+// schemaResponder returns the fields, types and units /telemetry sends, null until the game is known
+func schemaResponder(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case "GET":
+        EnableCors(&w)
+        w.Header().Set("Content-Type", "application/json")
+
+        schemaMu.Lock()
+        data := schemaData
+        schemaMu.Unlock()
+        w.Write(data)
+    default:
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        log.Printf("Not supported.")
+    }
+}
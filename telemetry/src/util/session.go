@@ -0,0 +1,331 @@
+package util
+
+import (
+    "bufio"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+// Session files hold every datagram a game sent so it can be replayed later.
+//
+// Layout: "FDTS", version byte, start time (unix nanoseconds, s64), followed by
+// one record per datagram:
+//   uvarint  microseconds since session start
+//   u8       address length (4 or 16), address bytes, u16 port
+//   uvarint  datagram length, datagram bytes
+
+const sessionMagic = "FDTS"
+const sessionVersion = 1
+
+// PacketReader is anything the game loop can read datagrams from
+type PacketReader interface {
+    ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+}
+
+// Recorder passes datagrams through from its source while writing them to a
+// session file. Games that talk back to their source send through it.
+type Recorder struct {
+    source PacketReader
+    file   *os.File
+    writer *bufio.Writer
+    start  time.Time
+    failed bool // a write failed, telemetry is passed through without recording
+    mu     sync.Mutex
+}
+
+// NewRecorder creates the session file and records everything read from source
+func NewRecorder(source PacketReader, path string) (*Recorder, error) {
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return nil, fmt.Errorf("failed to create directory: %w", err)
+    }
+
+    file, err := os.Create(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to create session file: %w", err)
+    }
+
+    r := &Recorder{
+        source: source,
+        file:   file,
+        writer: bufio.NewWriter(file),
+        start:  time.Now(),
+    }
+
+    header := make([]byte, len(sessionMagic)+1+8)
+    copy(header, sessionMagic)
+    header[len(sessionMagic)] = sessionVersion
+    binary.LittleEndian.PutUint64(header[len(sessionMagic)+1:], uint64(r.start.UnixNano()))
+    if _, err := r.writer.Write(header); err != nil {
+        file.Close()
+        return nil, fmt.Errorf("failed to write session header: %w", err)
+    }
+
+    return r, nil
+}
+
+// SetSource records from another source, only while nothing is reading from the recorder
+func (r *Recorder) SetSource(source PacketReader) {
+    r.source = source
+}
+
+// ReadFromUDP reads and records the next datagram. A failed write stops the
+// recording, not the telemetry.
+func (r *Recorder) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+    n, addr, err := r.source.ReadFromUDP(b)
+    if err == nil {
+        if werr := r.write(b[:n], addr); werr != nil {
+            log.Printf("Failed to record datagram, recording stopped: %v", werr)
+        }
+    }
+    return n, addr, err
+}
+
+// WriteToUDP sends through the source, when it is a socket
+func (r *Recorder) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+    conn, ok := r.source.(UDPConn)
+    if !ok {
+        return 0, errors.New("recorded source cannot send")
+    }
+    return conn.WriteToUDP(b, addr)
+}
+
+// SetReadDeadline sets the deadline of the source, when it is a socket
+func (r *Recorder) SetReadDeadline(t time.Time) error {
+    conn, ok := r.source.(UDPConn)
+    if !ok {
+        return errors.New("recorded source has no deadline")
+    }
+    return conn.SetReadDeadline(t)
+}
+
+func (r *Recorder) write(data []byte, addr *net.UDPAddr) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.failed {
+        return nil
+    }
+
+    var ip []byte
+    var port int
+    if addr != nil {
+        port = addr.Port
+        if ip = addr.IP.To4(); ip == nil {
+            ip = addr.IP.To16()
+        }
+    }
+
+    record := make([]byte, 0, 2*binary.MaxVarintLen64+1+len(ip)+2+len(data))
+    record = appendUvarint(record, uint64(time.Since(r.start)/time.Microsecond))
+    record = append(record, byte(len(ip)))
+    record = append(record, ip...)
+    record = append(record, byte(port), byte(port>>8))
+    record = appendUvarint(record, uint64(len(data)))
+    record = append(record, data...)
+
+    _, err := r.writer.Write(record)
+    r.failed = err != nil
+    return err
+}
+
+// Close flushes and closes the session file
+func (r *Recorder) Close() error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    if err := r.writer.Flush(); err != nil {
+        r.file.Close()
+        return err
+    }
+    return r.file.Close()
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+    var buf [binary.MaxVarintLen64]byte
+    n := binary.PutUvarint(buf[:], v)
+    return append(b, buf[:n]...)
+}
+
+// Replayer reads datagrams from a session file with their original timing
+type Replayer struct {
+    path   string
+    speed  float64
+    seek   time.Duration
+    loop   bool
+
+    reader *bufio.Reader
+    begin  time.Time // wall clock time matching the seek position
+
+    mu        sync.Mutex // guards file, reopened by the reader when looping and closed by Close
+    file      *os.File
+    closed    chan struct{} // interrupts the wait for the next datagram
+    closeOnce sync.Once
+}
+
+// NewReplayer opens a session file. speed scales playback (2 = twice as fast),
+// seek skips the start of the session and loop restarts it once finished.
+func NewReplayer(path string, speed float64, seek time.Duration, loop bool) (*Replayer, error) {
+    if speed <= 0 {
+        return nil, fmt.Errorf("invalid replay speed %v", speed)
+    }
+
+    r := &Replayer{
+        path:  path,
+        speed: speed,
+        seek:  seek,
+        loop:  loop,
+
+        closed: make(chan struct{}),
+    }
+    if err := r.open(); err != nil {
+        return nil, err
+    }
+    return r, nil
+}
+
+func (r *Replayer) open() error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    select {
+    case <-r.closed:
+        return os.ErrClosed
+    default:
+    }
+    if r.file != nil {
+        r.file.Close()
+    }
+
+    file, err := os.Open(r.path)
+    if err != nil {
+        return fmt.Errorf("failed to open session file: %w", err)
+    }
+
+    reader := bufio.NewReader(file)
+    header := make([]byte, len(sessionMagic)+1+8)
+    if _, err := io.ReadFull(reader, header); err != nil {
+        file.Close()
+        return fmt.Errorf("failed to read session header: %w", err)
+    }
+    if string(header[:len(sessionMagic)]) != sessionMagic {
+        file.Close()
+        return fmt.Errorf("%s is not a session file", r.path)
+    }
+    if header[len(sessionMagic)] != sessionVersion {
+        file.Close()
+        return fmt.Errorf("unsupported session version %d", header[len(sessionMagic)])
+    }
+
+    r.file = file
+    r.reader = reader
+    r.begin = time.Now()
+    return nil
+}
+
+// ReadFromUDP blocks until the next datagram is due and copies it into b.
+// io.EOF is returned at the end of the session unless looping.
+func (r *Replayer) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+    for {
+        select {
+        case <-r.closed:
+            return 0, nil, os.ErrClosed
+        default:
+        }
+
+        offset, addr, data, err := r.next()
+        if err == io.ErrUnexpectedEOF {
+            // Recording was cut off mid record, treat it as the end of the session
+            log.Printf("Session file %s ends with a truncated record", r.path)
+            err = io.EOF
+        }
+
+        if err == io.EOF && r.loop {
+            if err := r.open(); err != nil {
+                return 0, nil, err
+            }
+            continue
+        } else if err != nil {
+            return 0, nil, err
+        }
+
+        // Skip everything before the seek position without waiting
+        if offset < r.seek {
+            continue
+        }
+
+        due := r.begin.Add(time.Duration(float64(offset-r.seek) / r.speed))
+        if wait := time.Until(due); wait > 0 {
+            select {
+            case <-time.After(wait):
+            case <-r.closed:
+                return 0, nil, os.ErrClosed
+            }
+        }
+
+        return copy(b, data), addr, nil
+    }
+}
+
+func (r *Replayer) next() (time.Duration, *net.UDPAddr, []byte, error) {
+    micros, err := binary.ReadUvarint(r.reader)
+    if err != nil {
+        return 0, nil, nil, err
+    }
+
+    ipLength, err := r.reader.ReadByte()
+    if err != nil {
+        return 0, nil, nil, truncated(err)
+    }
+    if ipLength != 0 && ipLength != net.IPv4len && ipLength != net.IPv6len {
+        return 0, nil, nil, fmt.Errorf("corrupt session record: address length %d", ipLength)
+    }
+
+    addrBytes := make([]byte, int(ipLength)+2)
+    if _, err := io.ReadFull(r.reader, addrBytes); err != nil {
+        return 0, nil, nil, truncated(err)
+    }
+
+    length, err := binary.ReadUvarint(r.reader)
+    if err != nil {
+        return 0, nil, nil, truncated(err)
+    }
+    if length > 65535 {
+        return 0, nil, nil, fmt.Errorf("corrupt session record: datagram length %d", length)
+    }
+
+    data := make([]byte, length)
+    if _, err := io.ReadFull(r.reader, data); err != nil {
+        return 0, nil, nil, truncated(err)
+    }
+
+    addr := &net.UDPAddr{
+        IP:   net.IP(addrBytes[:ipLength]),
+        Port: int(addrBytes[ipLength]) | int(addrBytes[ipLength+1])<<8,
+    }
+    return time.Duration(micros) * time.Microsecond, addr, data, nil
+}
+
+func truncated(err error) error {
+    if errors.Is(err, io.EOF) {
+        return io.ErrUnexpectedEOF
+    }
+    return err
+}
+
+// Close closes the session file, a waiting ReadFromUDP returns os.ErrClosed
+func (r *Replayer) Close() error {
+    r.closeOnce.Do(func() {
+        close(r.closed)
+    })
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.file.Close()
+}
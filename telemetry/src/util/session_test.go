@@ -0,0 +1,196 @@
+package util
+
+import (
+    "bytes"
+    "errors"
+    "io"
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+type sessionDatagram struct {
+    offset time.Duration // since the session start
+    addr   *net.UDPAddr
+    data   []byte
+}
+
+var sessionDatagrams = []sessionDatagram{
+    {0, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 9999}, []byte("first")},
+    {100 * time.Millisecond, &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 20777}, []byte("second")},
+    {200 * time.Millisecond, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5606}, bytes.Repeat([]byte{0xAB}, 1500)},
+}
+
+// fakeSource hands out the session datagrams, then io.EOF
+type fakeSource struct {
+    datagrams []sessionDatagram
+}
+
+func (s *fakeSource) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+    if len(s.datagrams) == 0 {
+        return 0, nil, io.EOF
+    }
+    d := s.datagrams[0]
+    s.datagrams = s.datagrams[1:]
+    return copy(b, d.data), d.addr, nil
+}
+
+// recordSession records the session datagrams at their offsets without waiting for them
+func recordSession(t *testing.T) string {
+    path := filepath.Join(t.TempDir(), "session.fdts")
+    r, err := NewRecorder(&fakeSource{datagrams: sessionDatagrams}, path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    start := r.start
+    b := make([]byte, 2048)
+    for _, d := range sessionDatagrams {
+        r.start = time.Now().Add(-d.offset)
+        n, addr, err := r.ReadFromUDP(b)
+        if err != nil || !bytes.Equal(b[:n], d.data) || addr != d.addr {
+            t.Fatalf("recorder passed %q from %v (%v), want %q from %v", b[:n], addr, err, d.data, d.addr)
+        }
+    }
+    r.start = start
+    if err := r.Close(); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+func readDatagram(t *testing.T, r *Replayer, want sessionDatagram) {
+    t.Helper()
+    b := make([]byte, 2048)
+    n, addr, err := r.ReadFromUDP(b)
+    if err != nil {
+        t.Fatalf("reading %q: %v", want.data, err)
+    }
+    if !bytes.Equal(b[:n], want.data) {
+        t.Fatalf("replayed %d bytes, want %q", n, want.data)
+    }
+    if !addr.IP.Equal(want.addr.IP) || addr.Port != want.addr.Port {
+        t.Fatalf("replayed address %v, want %v", addr, want.addr)
+    }
+}
+
+func TestSessionReplay(t *testing.T) {
+    path := recordSession(t)
+
+    r, err := NewReplayer(path, 1, 0, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer r.Close()
+
+    start := time.Now()
+    for _, d := range sessionDatagrams {
+        readDatagram(t, r, d)
+    }
+    if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+        t.Errorf("session replayed in %s, recorded over 200ms", elapsed)
+    }
+    if _, _, err := r.ReadFromUDP(make([]byte, 2048)); err != io.EOF {
+        t.Errorf("end of session returned %v, want io.EOF", err)
+    }
+}
+
+func TestSessionSeekAndSpeed(t *testing.T) {
+    path := recordSession(t)
+
+    r, err := NewReplayer(path, 2, 150*time.Millisecond, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer r.Close()
+
+    // the datagram at 200ms is 50ms after the seek position, 25ms at twice the speed
+    start := time.Now()
+    readDatagram(t, r, sessionDatagrams[2])
+    if elapsed := time.Since(start); elapsed < 20*time.Millisecond || elapsed > 150*time.Millisecond {
+        t.Errorf("first datagram after the seek position took %s, want about 25ms", elapsed)
+    }
+}
+
+func TestSessionLoop(t *testing.T) {
+    path := recordSession(t)
+
+    r, err := NewReplayer(path, 100, 0, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer r.Close()
+
+    for round := 0; round < 3; round++ {
+        for _, d := range sessionDatagrams {
+            readDatagram(t, r, d)
+        }
+    }
+}
+
+func TestSessionCloseInterruptsReplay(t *testing.T) {
+    path := recordSession(t)
+
+    // a minute between the first two datagrams
+    r, err := NewReplayer(path, 1.0/600, 0, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    readDatagram(t, r, sessionDatagrams[0])
+
+    read := make(chan error, 1)
+    go func() {
+        _, _, err := r.ReadFromUDP(make([]byte, 2048))
+        read <- err
+    }()
+    time.Sleep(10 * time.Millisecond)
+    r.Close()
+
+    select {
+    case err := <-read:
+        if !errors.Is(err, os.ErrClosed) {
+            t.Errorf("closed replay returned %v, want os.ErrClosed", err)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("Close did not interrupt the replay")
+    }
+    if err := r.open(); !errors.Is(err, os.ErrClosed) {
+        t.Errorf("reopening a closed replay returned %v, want os.ErrClosed", err)
+    }
+}
+
+func TestSessionNotSession(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "not.fdts")
+    if err := os.WriteFile(path, []byte("not a session file"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := NewReplayer(path, 1, 0, false); err == nil {
+        t.Error("replaying a file without the session header did not fail")
+    }
+}
+
+func TestRecorderWriteFailure(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "session.fdts")
+    big := sessionDatagram{0, sessionDatagrams[0].addr, bytes.Repeat([]byte{1}, 5000)}
+    source := &fakeSource{datagrams: []sessionDatagram{big, big, big}}
+    r, err := NewRecorder(source, path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // datagrams larger than the write buffer go straight to the closed file
+    r.file.Close()
+
+    b := make([]byte, len(big.data))
+    for i := 0; i < 3; i++ {
+        n, _, err := r.ReadFromUDP(b)
+        if err != nil || n != len(big.data) {
+            t.Fatalf("read %d bytes (%v) after a failed write, want %d", n, err, len(big.data))
+        }
+    }
+    if !r.failed {
+        t.Error("recording did not stop after the write failed")
+    }
+    r.Close()
+}
@@ -0,0 +1,100 @@
+package util
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+    "sync"
+)
+
+// Status describes what the telemetry process is currently doing
+type Status struct {
+    Game      string `json:"game"`      // abbreviated game id, empty while detecting
+    Name      string `json:"name"`      // human readable game name
+    Detecting bool   `json:"detecting"` // waiting for packets to detect the game
+    Detected  bool   `json:"detected"`  // game was picked by auto detection
+
+    Degraded   bool   `json:"degraded"`            // reading packets is failing, the listener keeps retrying
+    ReadError  string `json:"readError,omitempty"` // last read error
+    ReadErrors int    `json:"readErrors"`          // read errors since the start
+    Rebinds    int    `json:"rebinds"`             // times the socket was bound again
+}
+
+var (
+    statusMu sync.Mutex
+    status   Status
+)
+
+// SetGame records the active game
+func SetGame(game string, name string, detected bool) {
+    statusMu.Lock()
+    defer statusMu.Unlock()
+    status.Game = game
+    status.Name = name
+    status.Detecting = false
+    status.Detected = detected
+}
+
+// SetDetecting marks the game as unknown until detection finishes
+func SetDetecting() {
+    SetSchema(nil)
+    statusMu.Lock()
+    defer statusMu.Unlock()
+    status.Game = ""
+    status.Name = ""
+    status.Detecting = true
+    status.Detected = false
+}
+
+// SetIdle marks that no game is read, capture was stopped
+func SetIdle() {
+    SetSchema(nil)
+    statusMu.Lock()
+    defer statusMu.Unlock()
+    status.Game = ""
+    status.Name = ""
+    status.Detecting = false
+    status.Detected = false
+}
+
+// SetReadError marks reading as degraded
+func SetReadError(err error) {
+    statusMu.Lock()
+    defer statusMu.Unlock()
+    status.Degraded = true
+    status.ReadError = err.Error()
+    status.ReadErrors++
+}
+
+// SetRebound counts a socket that was bound again after it broke
+func SetRebound() {
+    statusMu.Lock()
+    defer statusMu.Unlock()
+    status.Rebinds++
+}
+
+// SetReadRecovered clears the degraded state once packets arrive again, the last error is kept
+func SetReadRecovered() {
+    statusMu.Lock()
+    defer statusMu.Unlock()
+    status.Degraded = false
+}
+
+// GetStatus returns a copy of the current status
+func GetStatus() Status {
+    statusMu.Lock()
+    defer statusMu.Unlock()
+    return status
+}
+
+func statusResponder(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case "GET":
+        EnableCors(&w)
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(GetStatus())
+    default:
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        log.Printf("Not supported.")
+    }
+}
@@ -0,0 +1,192 @@
+package util
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// Websocket clients are told when a new frame is ready and send the latest
+// one when they get to it, so SetJson never blocks the UDP reader on a slow
+// dash and slow dashes skip frames instead of falling behind.
+
+type streamClient struct {
+    ready    chan struct{} // a new frame is ready, holds one notification
+    interval time.Duration // minimum time between frames, 0 = unlimited
+
+    subscribe chan subscribeRequest // from the reading goroutine, the latest request only
+}
+
+// streamMessage is sent by clients, {"subscribe": ["Speed", "TireTemp*:30"]}
+// changes the values they receive, an empty list sends everything again
+type streamMessage struct {
+    Subscribe []string `json:"subscribe"`
+}
+
+type subscribeRequest struct {
+    subscription *Subscription
+    err          error
+}
+
+var (
+    streamMu      sync.Mutex
+    streamClients = make(map[*streamClient]bool)
+    streamMaxRate = 60 // frames per second per client, 0 = unlimited
+)
+
+// SetStreamRate sets the maximum frames per second sent to each websocket client
+func SetStreamRate(rate int) {
+    streamMu.Lock()
+    defer streamMu.Unlock()
+    if rate < 0 {
+        rate = 0
+    }
+    streamMaxRate = rate
+}
+
+// publish tells every client a new frame is ready without blocking
+func publish() {
+    streamMu.Lock()
+    defer streamMu.Unlock()
+
+    for client := range streamClients {
+        client.notify()
+    }
+}
+
+func (c *streamClient) notify() {
+    select {
+    case c.ready <- struct{}{}:
+    default:
+        // already told
+    }
+}
+
+// request hands a subscription to the writing goroutine, replacing one it has not taken yet
+func (c *streamClient) request(request subscribeRequest) {
+    for {
+        select {
+        case c.subscribe <- request:
+            return
+        default:
+        }
+
+        select {
+        case <-c.subscribe:
+        default:
+        }
+    }
+}
+
+func streamResponder(w http.ResponseWriter, r *http.Request) {
+    streamMu.Lock()
+    rate := streamMaxRate
+    streamMu.Unlock()
+
+    // Clients may ask for a lower rate than the server maximum
+    if requested, err := strconv.Atoi(r.URL.Query().Get("rate")); err == nil && requested > 0 {
+        if rate == 0 || requested < rate {
+            rate = requested
+        }
+    }
+
+    subscription, err := ParseFields(r.URL.Query().Get("fields"))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    conn, err := upgradeWebsocket(w, r)
+    if err != nil {
+        log.Printf("Websocket upgrade failed: %v", err)
+        return
+    }
+
+    client := &streamClient{
+        ready:     make(chan struct{}, 1),
+        subscribe: make(chan subscribeRequest, 1),
+    }
+    if rate > 0 {
+        client.interval = time.Second / time.Duration(rate)
+    }
+
+    // Send the current state straight away so the dash does not wait for the next packet
+    client.notify()
+
+    streamMu.Lock()
+    streamClients[client] = true
+    streamMu.Unlock()
+
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        for {
+            data, err := conn.ReadMessage()
+            if err != nil {
+                return
+            }
+
+            var message streamMessage
+            var request subscribeRequest
+            if err := json.Unmarshal(data, &message); err != nil {
+                request.err = err
+            } else {
+                request.subscription, request.err = ParseSubscription(message.Subscribe)
+            }
+            client.request(request)
+        }
+    }()
+
+    defer func() {
+        streamMu.Lock()
+        delete(streamClients, client)
+        streamMu.Unlock()
+        conn.Close()
+    }()
+
+    var lastSent time.Time
+    schema := currentSchemaVersion()
+    for {
+        select {
+        case <-done:
+            return
+        case request := <-client.subscribe:
+            if request.err != nil {
+                reply, _ := json.Marshal(map[string]string{"error": request.err.Error()})
+                if err := conn.WriteText(reply); err != nil {
+                    return
+                }
+                continue
+            }
+            // the subscribed values of the current state right away
+            subscription = request.subscription
+            client.notify()
+        case <-client.ready:
+            if wait := client.interval - time.Since(lastSent); wait > 0 {
+                select {
+                case <-done:
+                    return
+                case <-time.After(wait):
+                }
+            }
+
+            // Values of the last game are not sent again, a null frame tells
+            // the client to drop them and the next frame holds every value
+            if version := currentSchemaVersion(); version != schema {
+                schema = version
+                if err := conn.WriteText([]byte(subscription.Project("null"))); err != nil {
+                    return
+                }
+            }
+
+            frame := subscription.Project(currentJson())
+            if err := conn.WriteText([]byte(frame)); err != nil {
+                return
+            }
+            lastSent = time.Now()
+        }
+    }
+}
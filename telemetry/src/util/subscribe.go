@@ -0,0 +1,245 @@
+package util
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// Subscription selects the values a client receives. Values are named as
+// in /schema, a trailing * matches every value starting with the name and
+// Parent.child picks a value of an object, ie: Normalized.speed. name:N only
+// sends the value in every Nth frame, clients keep the last value they got.
+type Subscription struct {
+    fields []subscribedField
+    frame  int // frames projected, for decimation
+    buf    []byte
+}
+
+type subscribedField struct {
+    name     string
+    prefix   bool // name ended with *
+    every    int  // send in every Nth frame
+    children []subscribedField
+}
+
+// ParseSubscription reads a list of values like "Speed", "TireTemp*:30" or
+// "Normalized.rpm". An empty list subscribes to everything and returns nil.
+func ParseSubscription(list []string) (*Subscription, error) {
+    s := &Subscription{}
+    for _, entry := range list {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+
+        every := 1
+        if name, n, ok := strings.Cut(entry, ":"); ok {
+            value, err := strconv.Atoi(n)
+            if err != nil || value <= 0 {
+                return nil, fmt.Errorf("invalid frame count '%s' for %s", n, name)
+            }
+            entry, every = name, value
+        }
+
+        fields := &s.fields
+        path := strings.Split(entry, ".")
+        for i, name := range path {
+            if name == "" || name == "*" && i < len(path)-1 {
+                return nil, fmt.Errorf("invalid value name '%s'", entry)
+            }
+            field := subscribedField{name: name, every: every}
+            if strings.HasSuffix(name, "*") {
+                field.name, field.prefix = strings.TrimSuffix(name, "*"), true
+            }
+            if i < len(path)-1 {
+                fields = field.child(fields)
+                continue
+            }
+            *fields = append(*fields, field)
+        }
+    }
+
+    if len(s.fields) == 0 {
+        return nil, nil
+    }
+    return s, nil
+}
+
+// ParseFields reads a comma separated subscription, as sent in a fields query parameter
+func ParseFields(fields string) (*Subscription, error) {
+    if fields == "" {
+        return nil, nil
+    }
+    return ParseSubscription(strings.Split(fields, ","))
+}
+
+// child returns the children of the object field in fields, adding it if needed
+func (f subscribedField) child(fields *[]subscribedField) *[]subscribedField {
+    for i := range *fields {
+        if (*fields)[i].name == f.name && !(*fields)[i].prefix && (*fields)[i].children != nil {
+            return &(*fields)[i].children
+        }
+    }
+    f.every, f.children = 1, []subscribedField{}
+    *fields = append(*fields, f)
+    return &(*fields)[len(*fields)-1].children
+}
+
+func (f subscribedField) matches(key string) bool {
+    if f.prefix {
+        return strings.HasPrefix(key, f.name)
+    }
+    return key == f.name
+}
+
+// Project returns the subscribed values of a telemetry frame, every call
+// counts as a frame for values sent every Nth frame. The first frame and the
+// first after the telemetry went stale hold every value. A nil subscription
+// returns the frame as it is.
+func (s *Subscription) Project(frame string) string {
+    if s == nil {
+        return frame
+    } else if frame == "null" || frame == "" {
+        s.frame = 0
+        return frame
+    }
+    s.buf = s.project(s.buf[:0], frame, s.fields)
+    s.frame++
+    return string(s.buf)
+}
+
+// project writes the members of the object data that match fields
+func (s *Subscription) project(b []byte, data string, fields []subscribedField) []byte {
+    b = append(b, '{')
+    empty := len(b)
+
+    scanObject(data, func(key, value string) {
+        var children []subscribedField
+        for _, field := range fields {
+            if field.children != nil {
+                if field.matches(key) && len(value) > 0 && value[0] == '{' {
+                    children = append(children, field.children...)
+                }
+                continue
+            }
+            if !field.matches(key) {
+                continue
+            }
+
+            if s.frame%field.every == 0 {
+                b = appendMember(b, empty, key, value)
+            }
+            return
+        }
+
+        if children != nil {
+            start := len(b)
+            b = appendMember(b, empty, key, "")
+            object := len(b)
+            if b = s.project(b, value, children); len(b)-object == 2 {
+                // nothing of the object this frame
+                b = b[:start]
+            }
+        }
+    })
+    return append(b, '}')
+}
+
+func appendMember(b []byte, empty int, key string, value string) []byte {
+    if len(b) > empty {
+        b = append(b, ',')
+    }
+    b = append(b, '"')
+    b = append(b, key...)
+    b = append(b, '"', ':')
+    return append(b, value...)
+}
+
+// scanObject calls member with the raw key and value of every member of a
+// JSON object, without decoding the values
+func scanObject(data string, member func(key string, value string)) {
+    i := skipSpace(data, 0)
+    if i >= len(data) || data[i] != '{' {
+        return
+    }
+    i++
+
+    for {
+        i = skipSpace(data, i)
+        if i >= len(data) || data[i] != '"' {
+            return
+        }
+        end := skipValue(data, i)
+        key := data[i+1 : end-1]
+
+        i = skipSpace(data, end)
+        if i >= len(data) || data[i] != ':' {
+            return
+        }
+        i = skipSpace(data, i+1)
+        end = skipValue(data, i)
+        if end <= i {
+            return
+        }
+        member(key, data[i:end])
+
+        i = skipSpace(data, end)
+        if i >= len(data) || data[i] != ',' {
+            return
+        }
+        i++
+    }
+}
+
+// skipValue returns the index after the JSON value starting at i
+func skipValue(data string, i int) int {
+    if i >= len(data) {
+        return i
+    }
+
+    switch data[i] {
+    case '"':
+        for i++; i < len(data); i++ {
+            switch data[i] {
+            case '\\':
+                i++
+            case '"':
+                return i + 1
+            }
+        }
+        return len(data)
+
+    case '{', '[':
+        depth := 0
+        for i < len(data) {
+            switch data[i] {
+            case '{', '[':
+                depth++
+            case '}', ']':
+                depth--
+                if depth == 0 {
+                    return i + 1
+                }
+            case '"':
+                i = skipValue(data, i)
+                continue
+            }
+            i++
+        }
+        return len(data)
+    }
+
+    // numbers, true, false and null
+    for i < len(data) && !strings.ContainsRune(",}] \t\r\n", rune(data[i])) {
+        i++
+    }
+    return i
+}
+
+func skipSpace(data string, i int) int {
+    for i < len(data) && (data[i] == ' ' || data[i] == '\t' || data[i] == '\r' || data[i] == '\n') {
+        i++
+    }
+    return i
+}
@@ -0,0 +1,154 @@
+package util
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+const subscribeFrame = `{"Speed":41.5,"TireTempFrontLeft":80,"TireTempFrontRight":81.5,` +
+    `"Track":"Spa, \"Francorchamps\" {GP}","Normalized":{"rpm":0.5,"speed":0.25},"Gear":3}`
+
+func TestSubscriptionProject(t *testing.T) {
+    cases := []struct {
+        fields []string
+        want   string
+    }{
+        {[]string{"Speed"}, `{"Speed":41.5}`},
+        {[]string{"TireTemp*"}, `{"TireTempFrontLeft":80,"TireTempFrontRight":81.5}`},
+        {[]string{"Normalized.rpm"}, `{"Normalized":{"rpm":0.5}}`},
+        {[]string{"Normalized"}, `{"Normalized":{"rpm":0.5,"speed":0.25}}`},
+        {[]string{"Normalized.*", "Speed"}, `{"Speed":41.5,"Normalized":{"rpm":0.5,"speed":0.25}}`},
+        {[]string{"Unknown", "Normalized.unknown", "Speed.rpm"}, `{}`},
+        // strings holding separators do not end the value
+        {[]string{"Gear", "Track"}, `{"Track":"Spa, \"Francorchamps\" {GP}","Gear":3}`},
+        {[]string{" Gear ", ""}, `{"Gear":3}`},
+    }
+    for _, c := range cases {
+        s, err := ParseSubscription(c.fields)
+        if err != nil {
+            t.Errorf("%q: %v", c.fields, err)
+            continue
+        }
+        if got := s.Project(subscribeFrame); got != c.want {
+            t.Errorf("%q projected %s, want %s", c.fields, got, c.want)
+        }
+    }
+
+    for _, list := range [][]string{nil, {}, {" ", ""}} {
+        if s, err := ParseSubscription(list); s != nil || err != nil {
+            t.Errorf("%q parsed as %v, %v, want everything", list, s, err)
+        }
+    }
+    var everything *Subscription
+    if got := everything.Project(subscribeFrame); got != subscribeFrame {
+        t.Errorf("nil subscription projected %s", got)
+    }
+}
+
+func TestSubscriptionErrors(t *testing.T) {
+    for _, fields := range []string{"Speed:0", "Speed:-1", "Speed:x", "TireTemp*:", "Normalized..rpm", "*.rpm", "."} {
+        if _, err := ParseFields(fields); err == nil {
+            t.Errorf("%q parsed without error", fields)
+        }
+    }
+}
+
+func TestSubscriptionDecimation(t *testing.T) {
+    s, err := ParseFields("Speed,TireTemp*:3,Normalized.rpm:2")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    all := `{"Speed":41.5,"TireTempFrontLeft":80,"TireTempFrontRight":81.5,"Normalized":{"rpm":0.5}}`
+    frames := []string{
+        all,
+        `{"Speed":41.5}`,
+        `{"Speed":41.5,"Normalized":{"rpm":0.5}}`,
+        `{"Speed":41.5,"TireTempFrontLeft":80,"TireTempFrontRight":81.5}`,
+        `{"Speed":41.5,"Normalized":{"rpm":0.5}}`,
+    }
+    for i, want := range frames {
+        if got := s.Project(subscribeFrame); got != want {
+            t.Errorf("frame %d projected %s, want %s", i, got, want)
+        }
+    }
+
+    // once the telemetry went stale the next frame holds every value again
+    if got := s.Project("null"); got != "null" {
+        t.Errorf("stale frame projected %s", got)
+    }
+    if got := s.Project(subscribeFrame); got != all {
+        t.Errorf("frame after stale projected %s, want %s", got, all)
+    }
+}
+
+func TestTelemetryFields(t *testing.T) {
+    SetJson([]byte(subscribeFrame))
+    defer SetJson(nil)
+
+    get := func(query string) *httptest.ResponseRecorder {
+        w := httptest.NewRecorder()
+        responder(w, httptest.NewRequest("GET", "/telemetry"+query, nil))
+        return w
+    }
+
+    if w := get("?fields=Speed,Normalized.rpm,Track"); w.Body.String() != `{"Speed":41.5,"Track":"Spa, \"Francorchamps\" {GP}","Normalized":{"rpm":0.5}}` {
+        t.Errorf("fields answered %s", w.Body)
+    }
+    // every Nth frame does not apply to a single frame
+    for i := 0; i < 2; i++ {
+        if w := get("?fields=Gear:5"); w.Body.String() != `{"Gear":3}` {
+            t.Errorf("decimated field answered %s", w.Body)
+        }
+    }
+    if w := get(""); w.Body.String() != subscribeFrame {
+        t.Errorf("no fields answered %s", w.Body)
+    }
+    if w := get("?fields=Speed:0"); w.Code != http.StatusBadRequest {
+        t.Errorf("invalid fields answered %d, want 400", w.Code)
+    }
+}
+
+func TestStreamSubscribe(t *testing.T) {
+    server := streamServer(t, subscribeFrame)
+
+    _, r := dialStream(t, server, "?fields=Speed,TireTemp*:2")
+    readText(t, r, `{"Speed":41.5,"TireTempFrontLeft":80,"TireTempFrontRight":81.5}`)
+    SetJson([]byte(subscribeFrame))
+    readText(t, r, `{"Speed":41.5}`)
+
+    conn, r := dialStream(t, server, "")
+    readText(t, r, subscribeFrame)
+
+    sendFrame(t, conn, true, opText, []byte(`{"subscribe":["Normalized.rpm","Track"]}`), true)
+    readText(t, r, `{"Track":"Spa, \"Francorchamps\" {GP}","Normalized":{"rpm":0.5}}`)
+
+    // an invalid subscription keeps the last one
+    sendFrame(t, conn, true, opText, []byte(`{"subscribe":["Speed:0"]}`), true)
+    _, reply := readFrame(t, r)
+    if !strings.Contains(string(reply), `"error"`) {
+        t.Errorf("invalid subscription answered %s", reply)
+    }
+    sendFrame(t, conn, true, opText, []byte(`not json`), true)
+    _, reply = readFrame(t, r)
+    if !strings.Contains(string(reply), `"error"`) {
+        t.Errorf("invalid message answered %s", reply)
+    }
+    SetJson([]byte(subscribeFrame))
+    readText(t, r, `{"Track":"Spa, \"Francorchamps\" {GP}","Normalized":{"rpm":0.5}}`)
+
+    // an empty list sends everything again
+    sendFrame(t, conn, true, opText, []byte(`{"subscribe":[]}`), true)
+    readText(t, r, subscribeFrame)
+
+    response, err := http.Get(server.URL + "/stream?fields=Speed:x")
+    if err != nil {
+        t.Fatal(err)
+    }
+    response.Body.Close()
+    if response.StatusCode != http.StatusBadRequest {
+        t.Errorf("invalid fields answered %s, want 400", response.Status)
+    }
+}
@@ -0,0 +1,351 @@
+package util
+
+import (
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+)
+
+// Transform is a conversion or derived value declared in a packet format
+// file, applied to every decoded packet before the game post processes it
+type Transform struct {
+    Position int    // line in the format file
+    Kind     string // scale, offset, unit, enum or derive
+    Name     string // value written
+    Source   string // value read by enum, the other kinds read Name or Expr
+
+    Scale  float64 // scale, offset and unit: Name = Name * Scale + Offset
+    Offset float64
+    Unit   string // unit the value is converted to, unit only
+
+    Labels map[int64]string // enum
+    Expr   *Expr            // derive
+}
+
+// Unit is a measurement unit known to unit transforms, values are converted
+// through the SI unit of the dimension
+type Unit struct {
+    Dimension string
+    Scale     float64 // SI = value * Scale + Offset
+    Offset    float64
+}
+
+var Units = map[string]Unit{
+    "m/s":  {"speed", 1, 0},
+    "km/h": {"speed", 1 / 3.6, 0},
+    "mph":  {"speed", 0.44704, 0},
+    "s":    {"time", 1, 0},
+    "ms":   {"time", 0.001, 0},
+    "min":  {"time", 60, 0},
+    "m":    {"distance", 1, 0},
+    "km":   {"distance", 1000, 0},
+    "mi":   {"distance", 1609.344, 0},
+    "C":    {"temperature", 1, 0},
+    "F":    {"temperature", 5.0 / 9, -160.0 / 9},
+    "K":    {"temperature", 1, -273.15},
+    "kPa":  {"pressure", 1, 0},
+    "bar":  {"pressure", 100, 0},
+    "psi":  {"pressure", 6.894757, 0},
+    "rad":  {"angle", 1, 0},
+    "deg":  {"angle", math.Pi / 180, 0},
+}
+
+// parseTransform reads a transform line, fields are the words before the comment:
+//   scale CurrentEngineRpm 10;
+//   offset LapNumber 1;
+//   unit Speed mph m/s;
+//   enum Weather WeatherName 0=Clear, 1=Light Cloud;
+//   derive DistanceLeft = StageLength - Odometer;
+func parseTransform(fields []string) (Transform, error) {
+    t := Transform{Kind: fields[0], Name: fields[1]}
+
+    switch t.Kind {
+    case "scale", "offset":
+        if len(fields) != 3 {
+            return t, fmt.Errorf("%s needs a field and a number", t.Kind)
+        }
+        value, err := strconv.ParseFloat(fields[2], 64)
+        if err != nil {
+            return t, fmt.Errorf("invalid %s '%s'", t.Kind, fields[2])
+        }
+        if t.Kind == "scale" {
+            t.Scale = value
+        } else {
+            t.Scale, t.Offset = 1, value
+        }
+
+    case "unit":
+        if len(fields) != 4 {
+            return t, fmt.Errorf("unit needs a field, the unit sent and the unit wanted")
+        }
+        from, ok := Units[fields[2]]
+        if !ok {
+            return t, fmt.Errorf("unknown unit '%s'", fields[2])
+        }
+        to, ok := Units[fields[3]]
+        if !ok {
+            return t, fmt.Errorf("unknown unit '%s'", fields[3])
+        }
+        if from.Dimension != to.Dimension {
+            return t, fmt.Errorf("cannot convert %s to %s", fields[2], fields[3])
+        }
+        t.Scale = from.Scale / to.Scale
+        t.Offset = (from.Offset - to.Offset) / to.Scale
+        t.Unit = fields[3]
+
+    case "enum":
+        if len(fields) < 4 {
+            return t, fmt.Errorf("enum needs a field, the name to write and its labels")
+        }
+        t.Source, t.Name = fields[1], fields[2]
+        t.Labels = make(map[int64]string)
+        for _, label := range strings.Split(strings.Join(fields[3:], " "), ",") {
+            parts := strings.SplitN(label, "=", 2)
+            if len(parts) != 2 {
+                return t, fmt.Errorf("invalid enum label '%s'", strings.TrimSpace(label))
+            }
+            value, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 0, 64)
+            if err != nil {
+                return t, fmt.Errorf("invalid enum value '%s'", strings.TrimSpace(parts[0]))
+            }
+            t.Labels[value] = strings.TrimSpace(parts[1])
+        }
+
+    case "derive":
+        text := strings.Join(fields[2:], " ")
+        if !strings.HasPrefix(text, "=") {
+            return t, fmt.Errorf("derive needs '=' after the field name")
+        }
+        expr, err := ParseExpr(text[1:])
+        if err != nil {
+            return t, err
+        }
+        t.Expr = expr
+    }
+
+    return t, nil
+}
+
+// Inputs returns the values a transform reads
+func (t Transform) Inputs() []string {
+    switch t.Kind {
+    case "enum":
+        return []string{t.Source}
+    case "derive":
+        return t.Expr.Names()
+    default:
+        return []string{t.Name}
+    }
+}
+
+// Apply computes the new value from lookup, ok is false when an input is missing
+func (t Transform) Apply(lookup func(string) (float64, bool)) (float64, bool) {
+    switch t.Kind {
+    case "enum":
+        return lookup(t.Source)
+    case "derive":
+        return t.Expr.Eval(lookup)
+    default:
+        value, ok := lookup(t.Name)
+        return value*t.Scale + t.Offset, ok
+    }
+}
+
+// Label returns the enum label of a value, the number itself when it has none
+func (t Transform) Label(value float64) string {
+    if label, ok := t.Labels[int64(value)]; ok {
+        return label
+    }
+    return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// String returns the transform as it is written in a format file
+func (t Transform) String() string {
+    switch t.Kind {
+    case "enum":
+        return fmt.Sprintf("%s = label(%s)", t.Name, t.Source)
+    case "derive":
+        return fmt.Sprintf("%s = %s", t.Name, t.Expr)
+    case "offset":
+        return fmt.Sprintf("%s = %s + %g", t.Name, t.Name, t.Offset)
+    case "scale":
+        return fmt.Sprintf("%s = %s * %g", t.Name, t.Name, t.Scale)
+    default:
+        return fmt.Sprintf("%s = %s * %g + %g", t.Name, t.Name, t.Scale, t.Offset)
+    }
+}
+
+// Expr is an arithmetic expression over packet values: numbers, value names,
+// + - * / and parentheses
+type Expr struct {
+    Op          byte // 0 for a number or a name
+    Left, Right *Expr
+    Name        string
+    Value       float64
+}
+
+// ParseExpr parses an expression such as "(StageLength - Odometer) / 1000"
+func ParseExpr(text string) (*Expr, error) {
+    p := &exprParser{text: text}
+    expr, err := p.sum()
+    if err != nil {
+        return nil, err
+    }
+    if p.skipSpace(); p.pos < len(p.text) {
+        return nil, fmt.Errorf("unexpected '%s' in expression", p.text[p.pos:])
+    }
+    return expr, nil
+}
+
+type exprParser struct {
+    text string
+    pos  int
+}
+
+func (p *exprParser) skipSpace() {
+    for p.pos < len(p.text) && p.text[p.pos] == ' ' {
+        p.pos++
+    }
+}
+
+// sum and product handle precedence, operators are left associative
+func (p *exprParser) sum() (*Expr, error) {
+    left, err := p.product()
+    for err == nil {
+        if p.skipSpace(); p.pos >= len(p.text) || (p.text[p.pos] != '+' && p.text[p.pos] != '-') {
+            return left, nil
+        }
+        op := p.text[p.pos]
+        p.pos++
+        var right *Expr
+        right, err = p.product()
+        left = &Expr{Op: op, Left: left, Right: right}
+    }
+    return nil, err
+}
+
+func (p *exprParser) product() (*Expr, error) {
+    left, err := p.operand()
+    for err == nil {
+        if p.skipSpace(); p.pos >= len(p.text) || (p.text[p.pos] != '*' && p.text[p.pos] != '/') {
+            return left, nil
+        }
+        op := p.text[p.pos]
+        p.pos++
+        var right *Expr
+        right, err = p.operand()
+        left = &Expr{Op: op, Left: left, Right: right}
+    }
+    return nil, err
+}
+
+func (p *exprParser) operand() (*Expr, error) {
+    p.skipSpace()
+    if p.pos >= len(p.text) {
+        return nil, fmt.Errorf("expression ends early")
+    }
+
+    c := p.text[p.pos]
+    switch {
+    case c == '(':
+        p.pos++
+        expr, err := p.sum()
+        if err != nil {
+            return nil, err
+        }
+        if p.skipSpace(); p.pos >= len(p.text) || p.text[p.pos] != ')' {
+            return nil, fmt.Errorf("missing ')' in expression")
+        }
+        p.pos++
+        return expr, nil
+
+    case c == '-':
+        p.pos++
+        operand, err := p.operand()
+        if err != nil {
+            return nil, err
+        }
+        return &Expr{Op: '-', Left: &Expr{}, Right: operand}, nil
+
+    case c == '.' || (c >= '0' && c <= '9'):
+        start := p.pos
+        for p.pos < len(p.text) && (p.text[p.pos] == '.' || p.text[p.pos] == 'x' || isNameChar(p.text[p.pos])) {
+            p.pos++
+        }
+        value, err := strconv.ParseFloat(p.text[start:p.pos], 64)
+        if err != nil {
+            return nil, fmt.Errorf("invalid number '%s' in expression", p.text[start:p.pos])
+        }
+        return &Expr{Value: value}, nil
+
+    case isNameChar(c):
+        start := p.pos
+        for p.pos < len(p.text) && isNameChar(p.text[p.pos]) {
+            p.pos++
+        }
+        return &Expr{Name: p.text[start:p.pos]}, nil
+    }
+    return nil, fmt.Errorf("unexpected '%c' in expression", c)
+}
+
+func isNameChar(c byte) bool {
+    return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// Eval computes the expression, ok is false when a value is missing or it divides by zero
+func (e *Expr) Eval(lookup func(string) (float64, bool)) (float64, bool) {
+    if e.Op == 0 {
+        if e.Name == "" {
+            return e.Value, true
+        }
+        return lookup(e.Name)
+    }
+
+    left, ok := e.Left.Eval(lookup)
+    if !ok {
+        return 0, false
+    }
+    right, ok := e.Right.Eval(lookup)
+    if !ok {
+        return 0, false
+    }
+
+    switch e.Op {
+    case '+':
+        return left + right, true
+    case '-':
+        return left - right, true
+    case '*':
+        return left * right, true
+    default:
+        if right == 0 {
+            return 0, false
+        }
+        return left / right, true
+    }
+}
+
+// Names returns the value names the expression reads
+func (e *Expr) Names() []string {
+    if e == nil {
+        return nil
+    }
+    if e.Op == 0 {
+        if e.Name == "" {
+            return nil
+        }
+        return []string{e.Name}
+    }
+    return append(e.Left.Names(), e.Right.Names()...)
+}
+
+func (e *Expr) String() string {
+    if e.Op == 0 {
+        if e.Name == "" {
+            return strconv.FormatFloat(e.Value, 'g', -1, 64)
+        }
+        return e.Name
+    }
+    return "(" + e.Left.String() + " " + string(e.Op) + " " + e.Right.String() + ")"
+}
@@ -1,5 +1,7 @@
 package util
 
+import "encoding/binary"
+
 // Telemetry struct represents a piece of telemetry as defined in the Forza data format (see the .dat files)
 type Telemetry struct {
     Position    int
@@ -7,4 +9,117 @@ type Telemetry struct {
     DataType    string
     StartOffset int
     EndOffset   int
-}
\ No newline at end of file
+    BigEndian   bool
+    Type        ValueType // DataType compiled when the format is loaded
+    Slot        int       // index of the value among the format's values, see AllFields
+}
+
+// ValueType is a data type name compiled to a number, decoding switches on
+// it for every field of every packet
+type ValueType uint8
+
+const (
+    TypeNone ValueType = iota // placeholders without a value
+    TypeS32
+    TypeU32
+    TypeF32
+    TypeU16
+    TypeS16
+    TypeU8
+    TypeS8
+    TypeU64
+    TypeF64
+    TypeBool
+    TypeString
+)
+
+// CompileType returns the ValueType of a data type name
+func CompileType(dataType string) ValueType {
+    switch dataType {
+    case "s32":
+        return TypeS32
+    case "u32":
+        return TypeU32
+    case "f32":
+        return TypeF32
+    case "u16":
+        return TypeU16
+    case "s16":
+        return TypeS16
+    case "u8":
+        return TypeU8
+    case "s8":
+        return TypeS8
+    case "u64":
+        return TypeU64
+    case "f64":
+        return TypeF64
+    case "bool":
+        return TypeBool
+    }
+    if StringLength(dataType) > 0 {
+        return TypeString
+    }
+    return TypeNone
+}
+
+// ByteOrder returns the byte order the field is encoded with
+func (T Telemetry) ByteOrder() binary.ByteOrder {
+    if T.BigEndian {
+        return binary.BigEndian
+    }
+    return binary.LittleEndian
+}
+// IsInteger reports whether the field holds an integer value
+func (T Telemetry) IsInteger() bool {
+    switch T.Type {
+    case TypeS32, TypeU32, TypeU16, TypeS16, TypeU8, TypeS8, TypeU64:
+        return true
+    }
+    return false
+}
+
+// Integer reads an integer field from a datagram
+func (T Telemetry) Integer(data []byte) (int64, bool) {
+    chunk := data[T.StartOffset:T.EndOffset]
+    order := T.ByteOrder()
+    switch T.Type {
+    case TypeS32:
+        return int64(int32(order.Uint32(chunk))), true
+    case TypeU32:
+        return int64(order.Uint32(chunk)), true
+    case TypeU16:
+        return int64(order.Uint16(chunk)), true
+    case TypeS16:
+        return int64(int16(order.Uint16(chunk))), true
+    case TypeU8:
+        return int64(chunk[0]), true
+    case TypeS8:
+        return int64(int8(chunk[0])), true
+    case TypeU64:
+        return int64(order.Uint64(chunk)), true
+    }
+    return 0, false
+}
+
+// Value decodes a field of any type from a datagram, nil for types without a value
+func (T Telemetry) Value(data []byte) interface{} {
+    chunk := data[T.StartOffset:T.EndOffset]
+    order := T.ByteOrder()
+    switch T.Type {
+    case TypeF32:
+        return Float32frombytesOrder(chunk, order)
+    case TypeF64:
+        return Float64frombytesOrder(chunk, order)
+    case TypeU64:
+        return order.Uint64(chunk)
+    case TypeBool:
+        return chunk[0] != 0
+    case TypeString:
+        return CString(chunk)
+    }
+    if value, ok := T.Integer(data); ok {
+        return value
+    }
+    return nil
+}
@@ -0,0 +1,264 @@
+package util
+
+import (
+    "bufio"
+    "crypto/sha1"
+    "encoding/base64"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Minimal RFC 6455 server side websocket, only what the dashboards need:
+// text frames out, messages reassembled from fragments and close/ping handling in.
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+    opContinuation = 0x0
+    opText         = 0x1
+    opBinary       = 0x2
+    opClose        = 0x8
+    opPing         = 0x9
+    opPong         = 0xA
+)
+
+// Close status codes
+const (
+    closeGoingAway     = 1001
+    closeProtocolError = 1002
+    closeTooBig        = 1009
+)
+
+const maxClientMessage = 4096 // clients only send control frames and small messages
+
+type wsConn struct {
+    conn    net.Conn
+    rw      *bufio.ReadWriter
+    writeMu sync.Mutex // pongs are written from the reader
+}
+
+// Hijacked connections are not closed by the HTTP server, they are tracked
+// here so shutting down closes them
+var (
+    wsMu    sync.Mutex
+    wsConns = make(map[*wsConn]bool)
+)
+
+// upgradeWebsocket performs the websocket handshake and hijacks the connection
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+    if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+        http.Error(w, "Expected websocket upgrade", http.StatusBadRequest)
+        return nil, errors.New("not a websocket request")
+    }
+
+    key := r.Header.Get("Sec-WebSocket-Key")
+    if key == "" {
+        http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+        return nil, errors.New("missing websocket key")
+    }
+
+    hijacker, ok := w.(http.Hijacker)
+    if !ok {
+        http.Error(w, "Websocket not supported", http.StatusInternalServerError)
+        return nil, errors.New("connection cannot be hijacked")
+    }
+
+    conn, rw, err := hijacker.Hijack()
+    if err != nil {
+        return nil, fmt.Errorf("failed to hijack connection: %w", err)
+    }
+
+    hash := sha1.Sum([]byte(key + websocketGUID))
+    accept := base64.StdEncoding.EncodeToString(hash[:])
+
+    fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n")
+    fmt.Fprintf(rw, "Upgrade: websocket\r\n")
+    fmt.Fprintf(rw, "Connection: Upgrade\r\n")
+    fmt.Fprintf(rw, "Sec-WebSocket-Accept: %s\r\n\r\n", accept)
+    if err := rw.Flush(); err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("failed to write handshake: %w", err)
+    }
+
+    c := &wsConn{conn: conn, rw: rw}
+    wsMu.Lock()
+    wsConns[c] = true
+    wsMu.Unlock()
+    return c, nil
+}
+
+// closeWebsockets tells every open websocket the server is going away and closes it
+func closeWebsockets() {
+    wsMu.Lock()
+    conns := make([]*wsConn, 0, len(wsConns))
+    for c := range wsConns {
+        conns = append(conns, c)
+    }
+    wsMu.Unlock()
+
+    for _, c := range conns {
+        // a stalled client does not hold up the shutdown
+        c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+        c.closeWith(closeGoingAway)
+        c.Close()
+    }
+}
+
+func headerContains(header http.Header, name string, value string) bool {
+    for _, v := range header.Values(name) {
+        for _, token := range strings.Split(v, ",") {
+            if strings.EqualFold(strings.TrimSpace(token), value) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// WriteText sends a single unfragmented text frame
+func (c *wsConn) WriteText(data []byte) error {
+    return c.writeFrame(opText, data)
+}
+
+func (c *wsConn) writeFrame(opcode byte, data []byte) error {
+    var header [10]byte
+    header[0] = 0x80 | opcode // FIN + opcode
+    headerLength := 2
+
+    length := len(data)
+    switch {
+    case length < 126:
+        header[1] = byte(length)
+    case length <= 0xFFFF:
+        header[1] = 126
+        binary.BigEndian.PutUint16(header[2:], uint16(length))
+        headerLength += 2
+    default:
+        header[1] = 127
+        binary.BigEndian.PutUint64(header[2:], uint64(length))
+        headerLength += 8
+    }
+
+    c.writeMu.Lock()
+    defer c.writeMu.Unlock()
+
+    if _, err := c.rw.Write(header[:headerLength]); err != nil {
+        return err
+    }
+    if _, err := c.rw.Write(data); err != nil {
+        return err
+    }
+    return c.rw.Flush()
+}
+
+// ReadMessage returns the next message, reassembled from its fragments,
+// answering pings along the way. io.EOF is returned when the client closes
+// the connection.
+func (c *wsConn) ReadMessage() ([]byte, error) {
+    var message []byte
+    fragmented := false // a message has started and waits for continuation frames
+
+    for {
+        var head [2]byte
+        if _, err := io.ReadFull(c.rw, head[:]); err != nil {
+            return nil, err
+        }
+
+        fin := head[0]&0x80 != 0
+        opcode := head[0] & 0x0F
+        masked := head[1]&0x80 != 0
+        length := uint64(head[1] & 0x7F)
+
+        // RFC 6455 5.1, a server must close the connection on an unmasked client frame
+        if !masked {
+            c.closeWith(closeProtocolError)
+            return nil, errors.New("unmasked client frame")
+        }
+
+        switch length {
+        case 126:
+            var ext [2]byte
+            if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+                return nil, err
+            }
+            length = uint64(binary.BigEndian.Uint16(ext[:]))
+        case 127:
+            var ext [8]byte
+            if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+                return nil, err
+            }
+            length = binary.BigEndian.Uint64(ext[:])
+        }
+
+        control := opcode&0x8 != 0
+        if control && (!fin || length > 125) {
+            c.closeWith(closeProtocolError)
+            return nil, fmt.Errorf("invalid control frame, opcode %d", opcode)
+        }
+        if length > maxClientMessage || !control && uint64(len(message))+length > maxClientMessage {
+            c.closeWith(closeTooBig)
+            return nil, fmt.Errorf("client message too large: %d bytes", uint64(len(message))+length)
+        }
+
+        var mask [4]byte
+        if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+            return nil, err
+        }
+
+        payload := make([]byte, length)
+        if _, err := io.ReadFull(c.rw, payload); err != nil {
+            return nil, err
+        }
+        for i := range payload {
+            payload[i] ^= mask[i%4]
+        }
+
+        switch opcode {
+        case opClose:
+            c.writeFrame(opClose, nil)
+            return nil, io.EOF
+        case opPing:
+            if err := c.writeFrame(opPong, payload); err != nil {
+                return nil, err
+            }
+        case opPong:
+            // nothing to do
+        case opText, opBinary, opContinuation:
+            if (opcode == opContinuation) != fragmented {
+                // a continuation without a start, or a new message before the last one ended
+                c.closeWith(closeProtocolError)
+                return nil, errors.New("unexpected websocket continuation")
+            }
+            message = append(message, payload...)
+            if !fin {
+                fragmented = true
+                continue
+            }
+            return message, nil
+        default:
+            c.closeWith(closeProtocolError)
+            return nil, fmt.Errorf("unknown websocket opcode %d", opcode)
+        }
+    }
+}
+
+// closeWith sends a close frame with a status code, the connection stays open
+func (c *wsConn) closeWith(code uint16) error {
+    var status [2]byte
+    binary.BigEndian.PutUint16(status[:], code)
+    return c.writeFrame(opClose, status[:])
+}
+
+func (c *wsConn) Close() error {
+    wsMu.Lock()
+    delete(wsConns, c)
+    wsMu.Unlock()
+    return c.conn.Close()
+}
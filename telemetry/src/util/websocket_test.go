@@ -0,0 +1,283 @@
+package util
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+// RFC 6455 1.3 example key and the accept value it expects
+const (
+    testKey    = "dGhlIHNhbXBsZSBub25jZQ=="
+    testAccept = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+)
+
+// streamServer serves /stream at full rate with the given telemetry
+func streamServer(t *testing.T, telemetry string) *httptest.Server {
+    t.Helper()
+    SetStreamRate(0)
+    SetJson([]byte(telemetry))
+    server := httptest.NewServer(http.HandlerFunc(streamResponder))
+    t.Cleanup(func() {
+        server.Close()
+        SetJson(nil)
+        SetStreamRate(60)
+    })
+    return server
+}
+
+// dialStream performs the handshake over a raw TCP connection
+func dialStream(t *testing.T, server *httptest.Server, query string) (net.Conn, *bufio.Reader) {
+    t.Helper()
+    conn, err := net.Dial("tcp", server.Listener.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+    request := "GET /stream" + query + " HTTP/1.1\r\n" +
+        "Host: " + server.Listener.Addr().String() + "\r\n" +
+        "Upgrade: websocket\r\n" +
+        "Connection: keep-alive, Upgrade\r\n" +
+        "Sec-WebSocket-Key: " + testKey + "\r\n" +
+        "Sec-WebSocket-Version: 13\r\n\r\n"
+    if _, err := io.WriteString(conn, request); err != nil {
+        t.Fatal(err)
+    }
+
+    r := bufio.NewReader(conn)
+    response, err := http.ReadResponse(r, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if response.StatusCode != http.StatusSwitchingProtocols {
+        t.Fatalf("handshake answered %s", response.Status)
+    }
+    if accept := response.Header.Get("Sec-WebSocket-Accept"); accept != testAccept {
+        t.Fatalf("accept key %q, want %q", accept, testAccept)
+    }
+    return conn, r
+}
+
+// sendFrame writes a client frame, masked unless the test wants otherwise
+func sendFrame(t *testing.T, conn net.Conn, fin bool, opcode byte, payload []byte, masked bool) {
+    t.Helper()
+    var frame bytes.Buffer
+    head := opcode
+    if fin {
+        head |= 0x80
+    }
+    frame.WriteByte(head)
+
+    maskBit := byte(0)
+    if masked {
+        maskBit = 0x80
+    }
+    switch {
+    case len(payload) < 126:
+        frame.WriteByte(maskBit | byte(len(payload)))
+    case len(payload) <= 0xFFFF:
+        frame.WriteByte(maskBit | 126)
+        binary.Write(&frame, binary.BigEndian, uint16(len(payload)))
+    default:
+        frame.WriteByte(maskBit | 127)
+        binary.Write(&frame, binary.BigEndian, uint64(len(payload)))
+    }
+
+    data := append([]byte(nil), payload...)
+    if masked {
+        mask := []byte{0x12, 0x34, 0x56, 0x78}
+        frame.Write(mask)
+        for i := range data {
+            data[i] ^= mask[i%4]
+        }
+    }
+    frame.Write(data)
+    if _, err := conn.Write(frame.Bytes()); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// readFrame reads a server frame, which must be unfragmented and unmasked
+func readFrame(t *testing.T, r *bufio.Reader) (byte, []byte) {
+    t.Helper()
+    var head [2]byte
+    if _, err := io.ReadFull(r, head[:]); err != nil {
+        t.Fatal(err)
+    }
+    if head[0]&0x80 == 0 || head[1]&0x80 != 0 {
+        t.Fatalf("server frame header % X, want FIN and no mask", head)
+    }
+
+    length := uint64(head[1] & 0x7F)
+    switch length {
+    case 126:
+        var ext [2]byte
+        io.ReadFull(r, ext[:])
+        length = uint64(binary.BigEndian.Uint16(ext[:]))
+    case 127:
+        var ext [8]byte
+        io.ReadFull(r, ext[:])
+        length = binary.BigEndian.Uint64(ext[:])
+    }
+    payload := make([]byte, length)
+    if _, err := io.ReadFull(r, payload); err != nil {
+        t.Fatal(err)
+    }
+    return head[0] & 0x0F, payload
+}
+
+func readText(t *testing.T, r *bufio.Reader, want string) {
+    t.Helper()
+    opcode, payload := readFrame(t, r)
+    if opcode != opText || string(payload) != want {
+        t.Fatalf("read frame %d %q, want text %q", opcode, payload, want)
+    }
+}
+
+// readClose expects a close frame with the status code, then the end of the connection
+func readClose(t *testing.T, r *bufio.Reader, code uint16) {
+    t.Helper()
+    opcode, payload := readFrame(t, r)
+    if opcode != opClose || len(payload) != 2 || binary.BigEndian.Uint16(payload) != code {
+        t.Fatalf("read frame %d % X, want close %d", opcode, payload, code)
+    }
+    // unread client data makes the close a reset
+    _, err := r.ReadByte()
+    if timeout, ok := err.(net.Error); err == nil || ok && timeout.Timeout() {
+        t.Errorf("connection still open after close: %v", err)
+    }
+}
+
+func TestStreamHandshake(t *testing.T) {
+    server := streamServer(t, `{"Speed":41.5}`)
+
+    // the current state is sent straight away
+    _, r := dialStream(t, server, "")
+    readText(t, r, `{"Speed":41.5}`)
+
+    response, err := http.Get(server.URL + "/stream")
+    if err != nil {
+        t.Fatal(err)
+    }
+    response.Body.Close()
+    if response.StatusCode != http.StatusBadRequest {
+        t.Errorf("plain GET answered %s, want 400", response.Status)
+    }
+}
+
+func TestStreamFragmentsAndPing(t *testing.T) {
+    server := streamServer(t, `{"Speed":41.5,"Gear":3}`)
+    conn, r := dialStream(t, server, "")
+    readText(t, r, `{"Speed":41.5,"Gear":3}`)
+
+    // a ping between the fragments of a message is answered at once
+    sendFrame(t, conn, false, opText, []byte(`{"subscribe":`), true)
+    sendFrame(t, conn, true, opPing, []byte("ping"), true)
+    opcode, payload := readFrame(t, r)
+    if opcode != opPong || string(payload) != "ping" {
+        t.Fatalf("ping answered with frame %d %q", opcode, payload)
+    }
+    sendFrame(t, conn, false, opContinuation, []byte(`["Gear"`), true)
+    sendFrame(t, conn, true, opContinuation, []byte(`]}`), true)
+    readText(t, r, `{"Gear":3}`)
+
+    // a pong and a large frame with an extended length
+    sendFrame(t, conn, true, opPong, nil, true)
+    subscribe := `{"subscribe":["Speed"` + strings.Repeat(`,"Speed"`, 20) + `]}`
+    sendFrame(t, conn, true, opText, []byte(subscribe), true)
+    readText(t, r, `{"Speed":41.5}`)
+
+    sendFrame(t, conn, true, opClose, nil, true)
+    if opcode, _ := readFrame(t, r); opcode != opClose {
+        t.Fatalf("close answered with frame %d", opcode)
+    }
+    if _, err := r.ReadByte(); err != io.EOF {
+        t.Errorf("connection still open after close: %v", err)
+    }
+}
+
+func TestStreamMessageLimit(t *testing.T) {
+    server := streamServer(t, `{"Speed":41.5}`)
+
+    conn, r := dialStream(t, server, "")
+    readText(t, r, `{"Speed":41.5}`)
+    sendFrame(t, conn, true, opText, bytes.Repeat([]byte(" "), maxClientMessage+1), true)
+    readClose(t, r, closeTooBig)
+
+    // fragments count towards the limit together
+    conn, r = dialStream(t, server, "")
+    readText(t, r, `{"Speed":41.5}`)
+    sendFrame(t, conn, false, opText, bytes.Repeat([]byte(" "), maxClientMessage/2), true)
+    sendFrame(t, conn, true, opContinuation, bytes.Repeat([]byte(" "), maxClientMessage/2+1), true)
+    readClose(t, r, closeTooBig)
+
+    // a message of exactly the limit is read
+    conn, r = dialStream(t, server, "")
+    readText(t, r, `{"Speed":41.5}`)
+    message := `{"subscribe":["Speed"]}`
+    message += strings.Repeat(" ", maxClientMessage-len(message))
+    sendFrame(t, conn, true, opText, []byte(message), true)
+    readText(t, r, `{"Speed":41.5}`)
+}
+
+func TestStreamProtocolErrors(t *testing.T) {
+    server := streamServer(t, `{"Speed":41.5}`)
+
+    frames := map[string]func(conn net.Conn){
+        "unmasked frame": func(conn net.Conn) {
+            sendFrame(t, conn, true, opText, []byte(`{"subscribe":[]}`), false)
+        },
+        "fragmented ping": func(conn net.Conn) {
+            sendFrame(t, conn, false, opPing, nil, true)
+        },
+        "continuation without a start": func(conn net.Conn) {
+            sendFrame(t, conn, true, opContinuation, []byte("x"), true)
+        },
+        "unknown opcode": func(conn net.Conn) {
+            sendFrame(t, conn, true, 0x3, nil, true)
+        },
+    }
+    for name, send := range frames {
+        t.Run(name, func(t *testing.T) {
+            conn, r := dialStream(t, server, "")
+            readText(t, r, `{"Speed":41.5}`)
+            send(conn)
+            readClose(t, r, closeProtocolError)
+        })
+    }
+}
+
+func TestStreamSlowClient(t *testing.T) {
+    server := streamServer(t, `{"Speed":41.5}`)
+
+    // a client that never reads fills its socket buffers
+    dialStream(t, server, "")
+    frame := []byte(`{"Padding":"` + strings.Repeat("x", 64*1024) + `"}`)
+
+    set := make(chan struct{})
+    go func() {
+        defer close(set)
+        for i := 0; i < 1000; i++ {
+            SetJson(frame)
+        }
+    }()
+    select {
+    case <-set:
+    case <-time.After(5 * time.Second):
+        t.Fatal("SetJson blocked on a client that does not read")
+    }
+
+    // other clients still get the latest frame
+    SetJson([]byte(`{"Speed":42}`))
+    _, r := dialStream(t, server, "")
+    readText(t, r, `{"Speed":42}`)
+}
@@ -227,18 +227,112 @@ const config = getJsonData('data/config.json');
 
 telemetry = null;
 telemetryType = ""
+stopping = null; // fdt process still storing its data after being stopped
 const options = {
     cwd: '../telemetry/', // Set the working directory
 };
 
+// fdt stores odometers and timing on SIGTERM, it is killed if that takes too long
+const stopTimeout = 10000;
+
+function stopTelemetry() {
+    const proc = telemetry;
+    telemetry = null;
+    if (proc.pending) {
+        // never started, the previous fdt is still stopping
+        return;
+    }
+    stopping = proc;
+
+    const timer = setTimeout(() => {
+        console.log("FDT did not stop in time, killing it");
+        proc.kill('SIGKILL');
+    }, stopTimeout);
+    proc.once('exit', () => {
+        clearTimeout(timer);
+        if (stopping == proc) {
+            stopping = null;
+        }
+    });
+    proc.kill('SIGTERM');
+}
+
+function startTelemetry(args) {
+    const proc = spawn('../telemetry/fdt', args, options);
+    proc.stdout.on('data', (data) => {
+        process.stdout.write(`FDT: ${data}`);
+    });
+    proc.stderr.on('data', (data) => {
+        process.stdout.write(`FDT: ${data}`);
+    });
+    proc.on('exit', () => {
+        if (telemetry == proc) {
+            // exited on its own, allow starting it again
+            telemetry = null;
+            telemetryType = "";
+        }
+    });
+    return proc;
+}
+
+// Change the running fdt through its control API instead of restarting it,
+// done gets an error message or null
+function controlTelemetry(change, done) {
+    const body = JSON.stringify(change);
+    const req = http.request({
+        host: '127.0.0.1',
+        port: 8888,
+        path: '/control',
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json', 'Content-Length': Buffer.byteLength(body) },
+    }, (res) => {
+        let data = '';
+        res.on('data', (chunk) => { data += chunk; });
+        res.on('end', () => {
+            try {
+                const report = JSON.parse(data);
+                done(report.error || null);
+            } catch (err) {
+                done(`Invalid control response: ${data}`);
+            }
+        });
+    });
+    req.on('error', (err) => done(err.message));
+    req.end(body);
+}
+
+// Give fdt the chance to store its data when the container stops
+function shutdown() {
+    const proc = telemetry != null && !telemetry.pending ? telemetry : stopping;
+    if (telemetry != null) {
+        stopTelemetry();
+    }
+    if (proc == null || proc.pending || proc.exitCode != null) {
+        process.exit(0);
+    }
+    proc.once('exit', () => process.exit(0));
+}
+process.on('SIGTERM', shutdown);
+process.on('SIGINT', shutdown);
+
 function reqGame(game) {
     retVal = JSON.parse(JSON.stringify(postReturn));
     game = game.toLowerCase();
     if (game == "stop") {
-        if (telemetry != null) {
+        if (telemetry != null && telemetryType != "") {
             telemetryType = "";
-            telemetry.kill('SIGKILL');
-            telemetry = null
+            if (telemetry.pending) {
+                stopTelemetry();
+            } else {
+                // fdt keeps running without capturing, the next game starts in place
+                const proc = telemetry;
+                controlTelemetry({ capture: false }, (err) => {
+                    if (err && telemetry == proc) {
+                        console.log(`Error stopping capture, stopping FDT: ${err}`);
+                        stopTelemetry();
+                    }
+                });
+            }
         } else {
             retVal.error = "Telemetry not running"
         }
@@ -255,27 +349,60 @@ function reqGame(game) {
         retVal.success = true;
 
     } else {
-        if (telemetry == null) {
+        if (telemetryType == "") {
             telemetryType = game
 
-            // Determine which port to use
-            const port = (config.useCustomPort && config.customPort) ? config.customPort.toString() : "9999";
+            // Determine which port to use, GT7 always sends to 33740, SMS games broadcast to 5606
+            const fixedPorts = { gt7: "33740", ams2: "5606", pc2: "5606" };
+            const defaultPort = fixedPorts[game] || "9999";
+            const port = (config.useCustomPort && config.customPort) ? config.customPort.toString() : defaultPort;
 
+            var args = ['-game', game.toUpperCase(), '-split', config.split, '-port', port];
+            if (game == "gt7" || game == "ac" || game == "acc") {
+                // These games only stream after fdt asks the console or PC running them
+                args.push('-host', config.gameHost || "");
+            }
+            if (game == "acc" && config.accPassword) {
+                args.push('-password', config.accPassword);
+            }
+            if ((game == "bng" || game == "lfs") && config.outsimPort) {
+                args.push('-outsim', config.outsimPort.toString());
+            }
             if (debug) {
-                telemetry = spawn('../telemetry/fdt', ['-game', game.toUpperCase(), '-split', config.split, "-d", '-port', port], options);
+                args.push("-d");
+            }
+            if (telemetry != null && !telemetry.pending) {
+                const change = {
+                    game: game.toUpperCase(), split: config.split, port: Number(port), capture: true,
+                    host: config.gameHost || "", outsim: 0, debug: Boolean(debug),
+                };
+                if (game == "acc" && config.accPassword) {
+                    change.password = config.accPassword;
+                }
+                if ((game == "bng" || game == "lfs") && config.outsimPort) {
+                    change.outsim = Number(config.outsimPort);
+                }
+                controlTelemetry(change, (err) => {
+                    if (err) {
+                        console.log(`Error starting ${game}: ${err}`);
+                        if (telemetryType == game) {
+                            telemetryType = "";
+                        }
+                    }
+                });
+            } else if (stopping != null) {
+                // the previous fdt still holds the ports, start once it is gone
+                const pending = { pending: true };
+                telemetry = pending;
+                stopping.once('exit', () => {
+                    if (telemetry == pending) {
+                        telemetry = startTelemetry(args);
+                    }
+                });
             } else {
-                telemetry = spawn('../telemetry/fdt', ['-game', game.toUpperCase(), '-split', config.split, '-port', port], options);
+                telemetry = startTelemetry(args);
             }
 
-
-            telemetry.stdout.on('data', (data) => {
-                process.stdout.write(`FDT: ${data}`);
-            });
-
-            telemetry.stderr.on('data', (data) => {
-                process.stdout.write(`FDT: ${data}`);
-            });
-
             retVal.success = true;
         } else {
             retVal.error = "Telemetry already running, stop before starting a new game"
@@ -366,6 +493,14 @@ function reqSplit(input) {
             fs.writeFileSync('data/config.json', JSON.stringify(config, null, 4));
         }
         config.split = input;
+        if (telemetry != null && !telemetry.pending && telemetryType != "") {
+            // the running fdt switches its splits in place
+            controlTelemetry({ split: input }, (err) => {
+                if (err) {
+                    console.log(`Error changing split type: ${err}`);
+                }
+            });
+        }
         retVal.success = true;
     }
     else if (input == "get") {
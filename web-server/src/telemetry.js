@@ -6,6 +6,17 @@ const ipAddress = window.location.href.match(/(?:https?|ftp):\/\/([^:/]+).*/) !=
 
 telemetry = null;
 telemetryType = null;
+stream = null;
+streamRetry = 0;
+
+// values the dashes read, tire values change slowly and are streamed in every 15th frame
+const telemetryFields = [
+    "IsRaceOn", "Speed", "CurrentEngineRpm", "EngineMaxRpm", "EngineIdleRpm",
+    "Gear", "GearMax", "GearNeutral", "GearReverse", "Accel", "Clutch", "HandBrake",
+    "Fuel", "RacePosition", "CurrentLap", "LastLap", "BestLap", "SessionBestLap", "CurrentTime",
+    "Split", "DistanceTraveled", "Odometer", "SurfaceRumble*", "TireCombinedSlip*",
+    "TireTemp*:15", "TireWear*:15",
+].join(",");
 
 
 defaultData = false;
@@ -16,12 +27,45 @@ setTimeout(function () {
     get_telemetryType()
 }, 250);
 
+// telemetry is pushed over a websocket, polling is only used until it connects
+function connect_stream() {
+    if (stream != null || !("WebSocket" in window) || Date.now() - streamRetry < 5000) {
+        return;
+    }
+    streamRetry = Date.now();
+
+    stream = new WebSocket('ws://' + ipAddress + ':8888/stream?fields=' + telemetryFields);
+    stream.onmessage = (event) => {
+        const frame = JSON.parse(event.data);
+        // values sent every Nth frame keep their last value in between, a null
+        // frame (stale telemetry or another game) drops them and the next frame
+        // holds every value, so it replaces the state instead of being merged
+        telemetry = (frame == null || telemetry == null) ? frame : Object.assign(telemetry, frame);
+    };
+    stream.onclose = () => {
+        stream = null;
+        telemetry = null;
+    };
+    stream.onerror = () => {
+        stream.close();
+    };
+}
+
 function get_data() {
     if (telemetryType == null) {
         telemetry = null;
+        if (stream != null) {
+            stream.close();
+        }
+        return;
+    }
+
+    connect_stream();
+    if (stream != null && stream.readyState == WebSocket.OPEN) {
         return;
     }
-    fetch('http://' + ipAddress + ':8888/telemetry')
+
+    fetch('http://' + ipAddress + ':8888/telemetry?fields=' + telemetryFields)
         .then(response => {
             // Check if the response is successful
             if (!response.ok) {
@@ -85,6 +129,10 @@ function get_telemetryType() {
     fetch('/telemetrytype')
         .then(response => response.json())
         .then(data => {
+            if (data["type"] != telemetryType) {
+                // values of the last game are not merged into the new one
+                telemetry = null;
+            }
             telemetryType = data["type"]
         })
         .catch(error => null);